@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const auditSubject = "admin.storages.audit"
+
+// AuditRecord describes a single SQL statement executed by a backend
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	Subject   string    `json:"subject"`
+	Alias     string    `json:"alias"`
+	DBType    string    `json:"dbtype"`
+	DBID      int       `json:"db_id"`
+	DBName    string    `json:"db_name"`
+	Statement string    `json:"statement"` // passwords are redacted
+	Duration  float64   `json:"duration"`  // in seconds
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLog appends audit records into a local file which is rotated when it reaches maxSize.
+// Records can be also published into NATS.
+type AuditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	publish    bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewAuditLog opens the audit file, path can be empty if only NATS is used
+func NewAuditLog(path string, maxSize int64, maxBackups int, publish bool) (*AuditLog, error) {
+	auditLog := &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		publish:    publish,
+	}
+
+	if path != "" {
+		err := auditLog.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return auditLog, nil
+}
+
+// auditLog is nil when audit is disabled
+var auditLog *AuditLog
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening audit file")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "opening audit file")
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file to path.1, path.1 to path.2 and so on, the oldest one is removed.
+// When the rotation fails the current file is opened again so records are not lost.
+func (a *AuditLog) rotate() error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		a.open()
+		return errors.Wrap(err, "closing audit file")
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.maxBackups > 0 {
+		err = os.Rename(a.path, a.path+".1")
+	} else {
+		err = os.Remove(a.path)
+	}
+	if err != nil {
+		a.open()
+		return errors.Wrap(err, "rotating audit file")
+	}
+
+	return a.open()
+}
+
+// write appends a single line into the audit file
+func (a *AuditLog) write(line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// File couldn't be opened after previous failed rotation
+	if a.file == nil {
+		err := a.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	var rotateErr error
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		rotateErr = a.rotate()
+		if a.file == nil {
+			return rotateErr
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "writing audit file")
+	}
+
+	err = a.file.Sync()
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+// Record saves the record into the file and publishes it into NATS if enabled
+func (a *AuditLog) Record(record AuditRecord) {
+	record.Statement = redactSQL(record.Statement)
+	record.Error = redactSQL(record.Error)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.WithError(err).Error("audit record can't be encoded")
+		return
+	}
+
+	if a.path != "" {
+		err = a.write(append(data, '\n'))
+		if err != nil {
+			logger.With(Fields{"event_id": record.EventID}).WithError(err).Error("audit record can't be saved")
+		}
+	}
+
+	if a.publish && nc != nil {
+		err = nc.Publish(auditSubject, data)
+		if err != nil {
+			logger.With(Fields{"event_id": record.EventID}).WithError(err).Error("audit record can't be published")
+		}
+	}
+}
+
+// Close closes the audit file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
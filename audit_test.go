@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	testAuditLog, err := NewAuditLog(path, 400, 2, false)
+	assert.Nil(t, err)
+	defer testAuditLog.Close()
+
+	for i := 0; i < 10; i++ {
+		testAuditLog.Record(AuditRecord{
+			EventID:   "abc",
+			Alias:     "devmysql",
+			Statement: "CREATE USER 'test'@'%' IDENTIFIED BY 'secret';",
+			Success:   true,
+		})
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "secret")
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	record := AuditRecord{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "abc", record.EventID)
+	assert.Equal(t, "CREATE USER 'test'@'%' IDENTIFIED BY '[REDACTED]';", record.Statement)
+
+	files, err := filepath.Glob(path + "*")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{path, path + ".1", path + ".2"}, files)
+}
+
+func TestAuditLogFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Non-empty directory in place of the backup can't be removed nor replaced
+	assert.Nil(t, os.MkdirAll(filepath.Join(path+".1", "keep"), 0700))
+
+	testAuditLog, err := NewAuditLog(path, 100, 1, false)
+	assert.Nil(t, err)
+	defer testAuditLog.Close()
+
+	line := []byte(strings.Repeat("a", 59) + "\n")
+	assert.Nil(t, testAuditLog.write(line))
+	assert.NotNil(t, testAuditLog.write(line))
+	assert.NotNil(t, testAuditLog.write(line))
+
+	// Records are kept in the current file
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat(string(line), 3), string(data))
+}
@@ -1,38 +1,497 @@
 package main
 
-import "strings"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/mysql"
+	"github.com/rosti-cz/storage_service/pgsql"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported values of dbtype
+var dbTypes = []string{"mysql", "mariadb", "pgsql"}
+
+// Alias is part of NATS subjects so it can't contain dots, wildcards or spaces
+var aliasRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// Extension names use the same format as backends accept
+var extensionRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\.]+$`)
+
+// Supported TLS modes of database connections
+var tlsModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// TLSConfig describes TLS connection to a database server
+type TLSConfig struct {
+	Mode       string `yaml:"mode"`        // disable (default), require, verify-ca or verify-full
+	CA         string `yaml:"ca"`          // path to CA bundle
+	Cert       string `yaml:"cert"`        // path to client certificate
+	Key        string `yaml:"key"`         // path to client key
+	ServerName string `yaml:"server_name"` // name verified in the server's certificate, MySQL/MariaDB only
+}
+
+// Validate checks the TLS configuration
+func (t *TLSConfig) Validate(dbType string) error {
+	if t.Mode != "" {
+		modeFound := false
+		for _, mode := range tlsModes {
+			if t.Mode == mode {
+				modeFound = true
+			}
+		}
+		if !modeFound {
+			return fmt.Errorf("unknown tls mode %q, use one of: %s", t.Mode, strings.Join(tlsModes, ", "))
+		}
+	}
+
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("tls cert and key have to be set together")
+	}
+	if t.ServerName != "" && dbType == "pgsql" {
+		return errors.New("tls server_name is not supported by pgsql, hostname is verified")
+	}
+	if t.Mode == "verify-ca" && t.CA == "" {
+		return errors.New("tls verify-ca mode needs ca")
+	}
+
+	return nil
+}
+
+// DatabaseLine is a single database server, it comes from DATABASES environment variable or from the config file
 type DatabaseLine struct {
-	Alias    string
-	DBType   string
-	Hostname string
-	Port     string
-	Username string
-	Password string
+	Alias    string `yaml:"alias"`
+	DBType   string `yaml:"dbtype"`
+	Hostname string `yaml:"hostname"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// PasswordSecret is reference to the password in a secret source like file:/run/secrets/pgsql,
+	// systemd:pgsql or vault:secret/data/pgsql#password, it can't be used together with Password.
+	PasswordSecret string `yaml:"password_secret"`
+
+	MaxOpenConns      int           `yaml:"max_open_conns"`     // 0 means unlimited
+	MaxIdleConns      int           `yaml:"max_idle_conns"`     // 0 means default of database/sql
+	ConnMaxLifetime   time.Duration `yaml:"conn_max_lifetime"`  // 0 means connections are reused forever
+	ConnectTimeout    time.Duration `yaml:"connect_timeout"`    // 0 means no timeout
+	QueryTimeout      time.Duration `yaml:"query_timeout"`      // 0 means no timeout
+	AllowedExtensions []string      `yaml:"allowed_extensions"` // empty means all extensions are allowed
+	Protected         []string      `yaml:"protected"`          // databases and users that can't be changed, * at the end matches a prefix
+	AuthPlugin        string        `yaml:"auth_plugin"`        // MySQL/MariaDB only, caching_sha2_password or mysql_native_password, server's default when empty
+	Hosts             []string      `yaml:"hosts"`              // MySQL/MariaDB only, hosts new users can connect from like 10.0.%, % when empty
+	SchemaStrategy    string        `yaml:"schema_strategy"`    // PostgreSQL only, public, database or both, database when empty
+
+	DatabaseDefaults dboptions.Options `yaml:"database_defaults"` // charset, collation, locale and template of new databases
+
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// Key returns key of the server used in DatabasesMap
+func (d *DatabaseLine) Key() string {
+	return d.Alias + ":" + d.DBType
+}
+
+// Untrusted procedural languages let users run code as the server's OS user,
+// they can be installed only when they are listed in allowed_extensions explicitly.
+var untrustedExtensions = []string{"plpythonu", "plpython2u", "plpython3u", "plperlu", "pltclu", "adminpack", "file_fdw"}
+
+// ExtensionAllowed returns true if the extension can be installed on this server
+func (d *DatabaseLine) ExtensionAllowed(extension string) bool {
+	if len(d.AllowedExtensions) == 0 {
+		for _, untrusted := range untrustedExtensions {
+			if untrusted == extension {
+				return false
+			}
+		}
+		return true
+	}
+	for _, allowed := range d.AllowedExtensions {
+		if allowed == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionChanged returns true if other server needs a different connection pool
+func (d *DatabaseLine) ConnectionChanged(other DatabaseLine) bool {
+	return d.Hostname != other.Hostname ||
+		d.Port != other.Port ||
+		d.Username != other.Username ||
+		d.Password != other.Password ||
+		d.ConnectTimeout != other.ConnectTimeout ||
+		d.TLS != other.TLS
+}
+
+// Validate checks the server's configuration
+func (d *DatabaseLine) Validate() error {
+	if !aliasRegexp.MatchString(d.Alias) {
+		return fmt.Errorf("invalid alias %q, only letters, numbers, _ and - are allowed", d.Alias)
+	}
+
+	dbTypeFound := false
+	for _, dbType := range dbTypes {
+		if d.DBType == dbType {
+			dbTypeFound = true
+		}
+	}
+	if !dbTypeFound {
+		return fmt.Errorf("unknown dbtype %q, use one of: %s", d.DBType, strings.Join(dbTypes, ", "))
+	}
+
+	if d.Hostname == "" {
+		return errors.New("hostname is required")
+	}
+	if d.Port < 1 || d.Port > 65535 {
+		return fmt.Errorf("invalid port %d", d.Port)
+	}
+	if d.Username == "" {
+		return errors.New("username is required")
+	}
+	if d.Password != "" && d.PasswordSecret != "" {
+		return errors.New("password and password_secret can't be used together")
+	}
+
+	if d.MaxOpenConns < 0 {
+		return errors.New("max_open_conns can't be negative")
+	}
+	if d.MaxIdleConns < 0 {
+		return errors.New("max_idle_conns can't be negative")
+	}
+	if d.ConnMaxLifetime < 0 || d.ConnectTimeout < 0 || d.QueryTimeout < 0 {
+		return errors.New("durations can't be negative")
+	}
+
+	err := d.TLS.Validate(d.DBType)
+	if err != nil {
+		return err
+	}
+
+	for _, extension := range d.AllowedExtensions {
+		if !extensionRegexp.MatchString(extension) {
+			return fmt.Errorf("invalid format of allowed extension %q", extension)
+		}
+	}
+
+	if d.AuthPlugin != "" {
+		if d.DBType == "pgsql" {
+			return errors.New("auth_plugin is supported only by mysql and mariadb")
+		}
+		pluginFound := false
+		for _, plugin := range mysql.AuthPlugins {
+			if d.AuthPlugin == plugin {
+				pluginFound = true
+			}
+		}
+		if !pluginFound {
+			return fmt.Errorf("unknown auth_plugin %q, use one of: %s", d.AuthPlugin, strings.Join(mysql.AuthPlugins, ", "))
+		}
+	}
+
+	if len(d.Hosts) > 0 && d.DBType == "pgsql" {
+		return errors.New("hosts are supported only by mysql and mariadb")
+	}
+	for _, host := range d.Hosts {
+		if err := mysql.ValidateHost(host); err != nil {
+			return fmt.Errorf("invalid host %q: %v", host, err)
+		}
+	}
+
+	if d.SchemaStrategy != "" {
+		if d.DBType != "pgsql" {
+			return errors.New("schema_strategy is supported only by pgsql")
+		}
+		strategyFound := false
+		for _, strategy := range pgsql.SchemaStrategies {
+			if d.SchemaStrategy == strategy {
+				strategyFound = true
+			}
+		}
+		if !strategyFound {
+			return fmt.Errorf("unknown schema_strategy %q, use one of: %s", d.SchemaStrategy, strings.Join(pgsql.SchemaStrategies, ", "))
+		}
+	}
+
+	err = d.DatabaseDefaults.Validate()
+	if err != nil {
+		return errors.Wrap(err, "database_defaults")
+	}
+	if d.DBType != "pgsql" && (d.DatabaseDefaults.Locale != "" || d.DatabaseDefaults.Template != "") {
+		return errors.New("database_defaults locale and template are supported only by pgsql")
+	}
+
+	for _, pattern := range d.Protected {
+		if pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+			return fmt.Errorf("invalid protected name %q, * is allowed only at the end", pattern)
+		}
+	}
+
+	return nil
+}
+
+// ConfigFile is structure of the YAML config file
+type ConfigFile struct {
+	Databases []DatabaseLine `yaml:"databases"`
 }
 
 type Config struct {
-	NATSURL            string `envconfig:"NATS_URL" required:"true"`
-	NATSToken          string `envconfig:"NATS_TOKEN" required:"false"`
-	Databases          string `envconfig:"DATABASES" required:"true"` // alias:dbtype:hostname:port:username:password separated by semicolon
-	NATSMetricsSubject string `envconfig:"NATS_METRICS_SUBJECT" required:"true" default:"svc.metrics"`
-	MetricsIdent       string `envconfig:"METRICS_IDENT" required:"true" default:"storage_service"`
+	NATSURL                string        `envconfig:"NATS_URL" required:"true"` // multiple servers can be separated by comma
+	NATSToken              string        `envconfig:"NATS_TOKEN" required:"false"`
+	NATSTokenSecret        string        `envconfig:"NATS_TOKEN_SECRET" required:"false"` // reference to the token in a secret source, see DatabaseLine.PasswordSecret
+	NATSUser               string        `envconfig:"NATS_USER" required:"false"`
+	NATSPassword           string        `envconfig:"NATS_PASSWORD" required:"false"`
+	NATSNKeySeed           string        `envconfig:"NATS_NKEY_SEED" required:"false"`                   // path to NKey seed file
+	NATSCreds              string        `envconfig:"NATS_CREDS" required:"false"`                       // path to JWT .creds file
+	NATSTLSCA              string        `envconfig:"NATS_TLS_CA" required:"false"`                      // path to CA bundle for verifying NATS servers
+	NATSTLSCert            string        `envconfig:"NATS_TLS_CERT" required:"false"`                    // path to client certificate for mutual TLS
+	NATSTLSKey             string        `envconfig:"NATS_TLS_KEY" required:"false"`                     // path to client key for mutual TLS
+	NATSMaxReconnects      int           `envconfig:"NATS_MAX_RECONNECTS" required:"false" default:"-1"` // -1 means reconnecting forever
+	NATSReconnectWait      time.Duration `envconfig:"NATS_RECONNECT_WAIT" required:"false" default:"2s"`
+	Databases              string        `envconfig:"DATABASES" required:"false"` // alias:dbtype:hostname:port:username:password separated by semicolon, legacy format, use CONFIG_FILE instead
+	ConfigFile             string        `envconfig:"CONFIG_FILE" required:"false"`
+	ConfigWatch            time.Duration `envconfig:"CONFIG_WATCH" required:"false"` // how often the config file is checked for changes, 0 disables it, SIGHUP reloads the config anytime
+	NATSMetricsSubject     string        `envconfig:"NATS_METRICS_SUBJECT" required:"true" default:"svc.metrics"`
+	MetricsIdent           string        `envconfig:"METRICS_IDENT" required:"true" default:"storage_service"`
+	HTTPListen             string        `envconfig:"HTTP_LISTEN" required:"false"`                        // address for the HTTP server with /metrics, /healthz and /readyz endpoints like :9100, disabled when empty
+	LogLevel               string        `envconfig:"LOG_LEVEL" required:"false" default:"info"`           // debug, info, warn or error
+	LogFormat              string        `envconfig:"LOG_FORMAT" required:"false" default:"json"`          // json or logfmt
+	AuditFile              string        `envconfig:"AUDIT_FILE" required:"false"`                         // path to the audit log of all executed SQL statements, disabled when empty
+	AuditMaxSize           int64         `envconfig:"AUDIT_MAX_SIZE" required:"false" default:"104857600"` // size in bytes when the audit file is rotated
+	AuditMaxBackups        int           `envconfig:"AUDIT_MAX_BACKUPS" required:"false" default:"10"`     // number of rotated audit files to keep
+	AuditPublish           bool          `envconfig:"AUDIT_PUBLISH" required:"false"`                      // publish audit records into admin.storages.audit subject
+	OTLPEndpoint           string        `envconfig:"OTLP_ENDPOINT" required:"false"`                      // OTLP/HTTP collector for traces like http://localhost:4318, disabled when empty
+	HealthTimeout          time.Duration `envconfig:"HEALTH_TIMEOUT" required:"false" default:"2s"`        // timeout of a single database server ping in /readyz
+	VaultAddr              string        `envconfig:"VAULT_ADDR" required:"false"`                         // address of Vault compatible API for vault: secrets
+	VaultToken             string        `envconfig:"VAULT_TOKEN" required:"false"`
+	SecretsRefresh         time.Duration `envconfig:"SECRETS_REFRESH" required:"false" default:"5m"` // how often secrets are read again, 0 disables it
+	EncryptionKeys         string        `envconfig:"ENCRYPTION_KEYS" required:"false"`              // base64 encoded X25519 private keys for decrypting passwords, separated by comma
+	EncryptionRequired     bool          `envconfig:"ENCRYPTION_REQUIRED" required:"false"`          // refuse messages with plaintext passwords
+	SigningHMACKeys        string        `envconfig:"SIGNING_HMAC_KEYS" required:"false"`            // base64 encoded HMAC-SHA256 secrets for verifying events, separated by comma
+	SigningEd25519Keys     string        `envconfig:"SIGNING_ED25519_KEYS" required:"false"`         // base64 encoded Ed25519 public keys for verifying events, separated by comma
+	SigningRequired        bool          `envconfig:"SIGNING_REQUIRED" required:"false"`             // refuse unsigned events
+	SigningWindow          time.Duration `envconfig:"SIGNING_WINDOW" required:"false" default:"5m"`  // maximal difference between event's timestamp and local time
+	PasswordMinLength      int           `envconfig:"PASSWORD_MIN_LENGTH" required:"false" default:"1"`
+	PasswordMinClasses     int           `envconfig:"PASSWORD_MIN_CLASSES" required:"false"`   // how many of lowercase, uppercase, digits and other characters the password has to contain
+	PasswordBreachedList   string        `envconfig:"PASSWORD_BREACHED_LIST" required:"false"` // path to file with breached passwords or their SHA-1 hashes, one per line
+	PasswordGenerate       bool          `envconfig:"PASSWORD_GENERATE" required:"false"`      // generate passwords missing in the events
+	PasswordGenerateLength int           `envconfig:"PASSWORD_GENERATE_LENGTH" required:"false" default:"24"`
+	AdminPublicKey         string        `envconfig:"ADMIN_PUBLIC_KEY" required:"false"` // base64 encoded X25519 public key for encrypting generated passwords
+
+	TerminateSessionsOnPasswordChange bool `envconfig:"TERMINATE_SESSIONS_ON_PASSWORD_CHANGE" required:"false"` // kill connections of the user after its password is changed
+
+	servers   []DatabaseLine // all database servers, filled by Load()
+	natsToken string         // NATSToken or resolved NATSTokenSecret
 }
 
-func (c *Config) DatabasesMap() map[string]DatabaseLine {
-	databaseMap := map[string]DatabaseLine{}
+// configLock protects parts of the config that can change while the service is running
+var configLock sync.RWMutex
+
+// loadLock makes sure only one Load() or RefreshSecrets() runs at the same time
+var loadLock sync.Mutex
+
+// parseDatabases parses the legacy DATABASES format. Password is the last field so it can contain colons.
+func parseDatabases(databases string) ([]DatabaseLine, error) {
+	servers := []DatabaseLine{}
 
-	for _, line := range strings.Split(c.Databases, ";") {
-		parts := strings.Split(line, ":")
-		databaseLine := DatabaseLine{
+	for i, line := range strings.Split(databases, ";") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 6)
+		if len(parts) != 6 {
+			return nil, fmt.Errorf("DATABASES line %d: expected alias:dbtype:hostname:port:username:password, got %d fields", i+1, len(parts))
+		}
+
+		port, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("DATABASES line %d: invalid port %q", i+1, parts[3])
+		}
+
+		servers = append(servers, DatabaseLine{
 			Alias:    parts[0],
 			DBType:   parts[1],
 			Hostname: parts[2],
-			Port:     parts[3],
+			Port:     port,
 			Username: parts[4],
 			Password: parts[5],
+		})
+	}
+
+	return servers, nil
+}
+
+// readConfigFile reads database servers from the YAML config file
+func readConfigFile(path string) ([]DatabaseLine, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	configFile := ConfigFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&configFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing config file "+path)
+	}
+
+	return configFile.Databases, nil
+}
+
+// Load reads database servers from CONFIG_FILE and DATABASES and validates them
+func (c *Config) Load() error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+
+	servers := []DatabaseLine{}
+
+	if c.ConfigFile != "" {
+		fileServers, err := readConfigFile(c.ConfigFile)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, fileServers...)
+	}
+
+	legacyServers, err := parseDatabases(c.Databases)
+	if err != nil {
+		return err
+	}
+	servers = append(servers, legacyServers...)
+
+	if len(servers) == 0 {
+		return errors.New("no database servers configured, set CONFIG_FILE or DATABASES")
+	}
+
+	resolver := c.secretResolver()
+	for i := range servers {
+		if servers[i].PasswordSecret == "" {
+			continue
+		}
+		password, err := resolver.Resolve(servers[i].PasswordSecret)
+		if err != nil {
+			return fmt.Errorf("database server %d (%s): %s", i+1, servers[i].Key(), err.Error())
+		}
+		servers[i].Password = password
+	}
+
+	natsToken := c.NATSToken
+	if c.NATSTokenSecret != "" {
+		if c.NATSToken != "" {
+			return errors.New("NATS_TOKEN and NATS_TOKEN_SECRET can't be used together")
+		}
+		token, err := resolver.Resolve(c.NATSTokenSecret)
+		if err != nil {
+			return errors.Wrap(err, "NATS token")
+		}
+		natsToken = token
+	}
+
+	keys := map[string]bool{}
+	for i, server := range servers {
+		err := server.Validate()
+		if err != nil {
+			return fmt.Errorf("database server %d (%s): %s", i+1, server.Key(), err.Error())
+		}
+		if keys[server.Key()] {
+			return fmt.Errorf("database server %d (%s): duplicate alias and dbtype", i+1, server.Key())
+		}
+		keys[server.Key()] = true
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	c.servers = servers
+	c.natsToken = natsToken
+
+	return nil
+}
+
+func (c *Config) secretResolver() *SecretResolver {
+	return NewSecretResolver(c.VaultAddr, c.VaultToken)
+}
+
+// RefreshSecrets reads all secrets again and returns servers which passwords have changed,
+// the old versions of the servers are returned so their connection pools can be closed.
+func (c *Config) RefreshSecrets() ([]DatabaseLine, error) {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+
+	resolver := c.secretResolver()
+
+	configLock.RLock()
+	servers := make([]DatabaseLine, len(c.servers))
+	copy(servers, c.servers)
+	natsToken := c.natsToken
+	configLock.RUnlock()
+
+	var lastErr error
+	changed := []DatabaseLine{}
+	for i := range servers {
+		if servers[i].PasswordSecret == "" {
+			continue
 		}
-		databaseMap[databaseLine.Alias+":"+databaseLine.DBType] = databaseLine
+		password, err := resolver.Resolve(servers[i].PasswordSecret)
+		if err != nil {
+			lastErr = errors.Wrap(err, servers[i].Key())
+			continue
+		}
+		if password != servers[i].Password {
+			changed = append(changed, servers[i])
+			servers[i].Password = password
+		}
+	}
+
+	if c.NATSTokenSecret != "" {
+		token, err := resolver.Resolve(c.NATSTokenSecret)
+		if err != nil {
+			lastErr = errors.Wrap(err, "NATS token")
+		} else {
+			natsToken = token
+		}
+	}
+
+	configLock.Lock()
+	c.servers = servers
+	c.natsToken = natsToken
+	configLock.Unlock()
+
+	return changed, lastErr
+}
+
+// Servers returns all database servers
+func (c *Config) Servers() []DatabaseLine {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	servers := make([]DatabaseLine, len(c.servers))
+	copy(servers, c.servers)
+	return servers
+}
+
+// NATSAuthToken returns the current NATS token
+func (c *Config) NATSAuthToken() string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return c.natsToken
+}
+
+// DatabasesMap returns all database servers, key is alias:dbtype
+func (c *Config) DatabasesMap() map[string]DatabaseLine {
+	databaseMap := map[string]DatabaseLine{}
+
+	for _, databaseLine := range c.Servers() {
+		databaseMap[databaseLine.Key()] = databaseLine
 	}
 
 	return databaseMap
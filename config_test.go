@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLoadLegacy(t *testing.T) {
+	testConfig := Config{
+		Databases: "devmysql:mariadb:192.168.122.127:3306:rosti:pass:with:colons;devpgsql:pgsql:192.168.122.127:5432:rosti:rosti",
+	}
+	assert.Nil(t, testConfig.Load())
+
+	databases := testConfig.DatabasesMap()
+	assert.Len(t, databases, 2)
+	assert.Equal(t, "pass:with:colons", databases["devmysql:mariadb"].Password)
+	assert.Equal(t, 5432, databases["devpgsql:pgsql"].Port)
+}
+
+func TestConfigLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	err := ioutil.WriteFile(path, []byte(`
+databases:
+  - alias: devpgsql
+    dbtype: pgsql
+    hostname: "::1"
+    port: 5432
+    username: rosti
+    password: "p;a:s's"
+    max_open_conns: 5
+    connect_timeout: 5s
+    allowed_extensions: [pg_trgm, unaccent]
+`), 0600)
+	assert.Nil(t, err)
+
+	testConfig := Config{ConfigFile: path, Databases: "devmysql:mariadb:localhost:3306:rosti:rosti"}
+	assert.Nil(t, testConfig.Load())
+
+	databases := testConfig.DatabasesMap()
+	assert.Len(t, databases, 2)
+	server := databases["devpgsql:pgsql"]
+	assert.Equal(t, "::1", server.Hostname)
+	assert.Equal(t, "p;a:s's", server.Password)
+	assert.Equal(t, 5, server.MaxOpenConns)
+	assert.Equal(t, 5*time.Second, server.ConnectTimeout)
+	assert.True(t, server.ExtensionAllowed("pg_trgm"))
+	assert.False(t, server.ExtensionAllowed("plpython3u"))
+
+	// Untrusted extensions are denied without allow-list too
+	server = DatabaseLine{DBType: "pgsql"}
+	assert.True(t, server.ExtensionAllowed("hstore"))
+	assert.False(t, server.ExtensionAllowed("plperlu"))
+	server.AllowedExtensions = []string{"plperlu"}
+	assert.True(t, server.ExtensionAllowed("plperlu"))
+}
+
+func TestConfigLoadErrors(t *testing.T) {
+	tests := map[string]string{
+		"devmysql:mariadb:localhost":                                "expected alias:dbtype:hostname:port:username:password",
+		"devmysql:mariadb:localhost:port:rosti:rosti":               "invalid port",
+		"devmysql:oracle:localhost:3306:rosti:rosti":                "unknown dbtype",
+		"dev.mysql:mariadb:localhost:3306:rosti:rosti":              "invalid alias",
+		"devmysql:mariadb::3306:rosti:rosti":                        "hostname is required",
+		"a:mysql:localhost:3306:rosti:rosti;a:mysql:other:3306:r:r": "duplicate alias",
+		"": "no database servers configured",
+	}
+
+	for databases, expected := range tests {
+		testConfig := Config{Databases: databases}
+		err := testConfig.Load()
+		if assert.NotNil(t, err, databases) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+
+	testConfig := Config{ConfigFile: "/nonexistent/config.yml"}
+	assert.NotNil(t, testConfig.Load())
+
+	databaseLine := DatabaseLine{Alias: "devmysql", DBType: "mysql", Hostname: "localhost", Port: 3306, Username: "rosti", Protected: []string{"*_backup"}}
+	err := databaseLine.Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid protected name")
+	}
+
+	databaseLine = DatabaseLine{Alias: "devpgsql", DBType: "pgsql", Hostname: "localhost", Port: 5432, Username: "rosti", Hosts: []string{"10.0.%"}}
+	err = databaseLine.Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "hosts are supported only by mysql")
+	}
+
+	databaseLine = DatabaseLine{Alias: "devpgsql", DBType: "pgsql", Hostname: "localhost", Port: 5432, Username: "rosti", SchemaStrategy: "private"}
+	err = databaseLine.Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "unknown schema_strategy")
+	}
+	databaseLine.SchemaStrategy = "both"
+	assert.Nil(t, databaseLine.Validate())
+}
+
+func TestNATSOptions(t *testing.T) {
+	_, err := natsOptions(&Config{NATSUser: "storage", NATSPassword: "secret", NATSReconnectWait: time.Second})
+	assert.Nil(t, err)
+
+	_, err = natsOptions(&Config{NATSUser: "storage", NATSCreds: "/etc/storage_service/nats.creds"})
+	assert.NotNil(t, err)
+
+	_, err = natsOptions(&Config{NATSTLSCert: "/etc/storage_service/client.crt"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,60 @@
+// Package dboptions holds charset, collation, locale and template of new databases coming from events
+// and from database_defaults of the servers. Only the format of the names is checked here,
+// whether the server knows them is up to the backend and CREATE DATABASE.
+package dboptions
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Names of charsets, collations, locales and templates, backends check they exist on the server
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\.@\-]+$`)
+
+// Options of a database, empty values mean server's default.
+// Backends return error when an option they don't support is set.
+type Options struct {
+	Charset   string `json:"charset" yaml:"charset"`     // CHARACTER SET in MySQL, ENCODING in PostgreSQL
+	Collation string `json:"collation" yaml:"collation"` // COLLATE in MySQL, LC_COLLATE in PostgreSQL
+	Locale    string `json:"locale" yaml:"locale"`       // PostgreSQL only, LOCALE (both LC_COLLATE and LC_CTYPE)
+	Template  string `json:"template" yaml:"template"`   // PostgreSQL only, template database
+}
+
+// Validate checks format of the options
+func (o Options) Validate() error {
+	values := map[string]string{
+		"charset":   o.Charset,
+		"collation": o.Collation,
+		"locale":    o.Locale,
+		"template":  o.Template,
+	}
+	for name, value := range values {
+		if value != "" && !nameRegexp.MatchString(value) {
+			return errors.New("invalid format of " + name)
+		}
+	}
+	return nil
+}
+
+// Merge returns options with empty values replaced by values from defaults.
+// Default charset and collation are used only when neither of them is set,
+// collation alone says the charset and it doesn't have to be the default one.
+func (o Options) Merge(defaults Options) Options {
+	if o.Charset == "" && o.Collation == "" {
+		o.Charset = defaults.Charset
+		o.Collation = defaults.Collation
+	}
+	if o.Locale == "" {
+		o.Locale = defaults.Locale
+	}
+	if o.Template == "" {
+		o.Template = defaults.Template
+	}
+	return o
+}
+
+// IsEmpty returns true if no option is set
+func (o Options) IsEmpty() bool {
+	return o == Options{}
+}
@@ -0,0 +1,37 @@
+package dboptions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Options{}.Validate())
+	assert.Nil(t, Options{Charset: "utf8mb4", Collation: "utf8mb4_czech_ci"}.Validate())
+	assert.Nil(t, Options{Charset: "UTF8", Locale: "cs_CZ.UTF-8", Template: "template0"}.Validate())
+	assert.Nil(t, Options{Locale: "sr_RS@latin", Template: "template-utf8"}.Validate())
+	assert.EqualError(t, Options{Collation: "x' OR '1"}.Validate(), "invalid format of collation")
+	assert.EqualError(t, Options{Locale: "cs CZ"}.Validate(), "invalid format of locale")
+	assert.EqualError(t, Options{Template: `"template0"`}.Validate(), "invalid format of template")
+}
+
+func TestMerge(t *testing.T) {
+	defaults := Options{Charset: "utf8mb4", Collation: "utf8mb4_unicode_ci"}
+
+	assert.Equal(t, defaults, Options{}.Merge(defaults))
+	// Collation alone keeps the charset empty, the server derives it from the collation
+	assert.Equal(t, Options{Collation: "utf8mb4_czech_ci"}, Options{Collation: "utf8mb4_czech_ci"}.Merge(defaults))
+	assert.Equal(t, Options{Collation: "latin2_czech_cs"}, Options{Collation: "latin2_czech_cs"}.Merge(defaults))
+	// Other charset doesn't get the default collation
+	assert.Equal(t, Options{Charset: "latin2"}, Options{Charset: "latin2"}.Merge(defaults))
+
+	// PostgreSQL options are merged one by one
+	pgDefaults := Options{Charset: "UTF8", Locale: "en_US.UTF-8", Template: "template0"}
+	assert.Equal(t, Options{Charset: "UTF8", Locale: "cs_CZ.UTF-8", Template: "template0"}, Options{Locale: "cs_CZ.UTF-8"}.Merge(pgDefaults))
+}
+
+func TestIsEmpty(t *testing.T) {
+	assert.True(t, Options{}.IsEmpty())
+	assert.False(t, Options{Template: "template0"}.IsEmpty())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Prefix of encrypted password fields, the rest is base64 encoded NaCl sealed box (crypto_box_seal)
+const encryptedPrefix = "box:"
+
+type encryptionKey struct {
+	public  [32]byte
+	private [32]byte
+}
+
+// PasswordDecrypter decrypts password fields of incoming messages encrypted by the admin
+// with one of the service's public keys. More keys can be active at the same time so
+// they can be rotated without losing messages encrypted by the old key.
+type PasswordDecrypter struct {
+	keys     []encryptionKey
+	required bool
+}
+
+// NewPasswordDecrypter returns decrypter using base64 encoded X25519 private keys separated by comma or whitespace.
+// If required is true plaintext passwords are refused.
+func NewPasswordDecrypter(privateKeys string, required bool) (*PasswordDecrypter, error) {
+	decrypter := &PasswordDecrypter{required: required}
+
+	for _, field := range splitKeys(privateKeys) {
+		data, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid encryption key")
+		}
+		if len(data) != 32 {
+			return nil, errors.New("invalid encryption key, it has to be 32 bytes long")
+		}
+
+		key := encryptionKey{}
+		copy(key.private[:], data)
+		public, err := curve25519.X25519(key.private[:], curve25519.Basepoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid encryption key")
+		}
+		copy(key.public[:], public)
+
+		decrypter.keys = append(decrypter.keys, key)
+	}
+
+	if required && len(decrypter.keys) == 0 {
+		return nil, errors.New("encryption is required but there is no encryption key")
+	}
+
+	return decrypter, nil
+}
+
+// splitKeys splits list of keys separated by comma or whitespace
+func splitKeys(keys string) []string {
+	return strings.FieldsFunc(keys, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+}
+
+// passwordDecrypter is replaced in _init() based on the config
+var passwordDecrypter = &PasswordDecrypter{}
+
+// PublicKeys returns base64 encoded public keys the admin should encrypt passwords with
+func (d *PasswordDecrypter) PublicKeys() []string {
+	keys := []string{}
+	for _, key := range d.keys {
+		keys = append(keys, base64.StdEncoding.EncodeToString(key.public[:]))
+	}
+	return keys
+}
+
+// Decrypt returns plaintext of the value, values without the box: prefix are returned as they are
+// unless encryption is required. Empty value is never encrypted.
+func (d *PasswordDecrypter) Decrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		if d.required {
+			return "", errors.New("password is not encrypted")
+		}
+		return value, nil
+	}
+	if len(d.keys) == 0 {
+		return "", errors.New("password is encrypted but there is no encryption key")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "invalid encrypted password")
+	}
+
+	for _, key := range d.keys {
+		plaintext, ok := box.OpenAnonymous(nil, sealed, &key.public, &key.private)
+		if ok {
+			return string(plaintext), nil
+		}
+	}
+
+	return "", errors.New("password can't be decrypted by any of the encryption keys")
+}
+
+// DecryptMessage decrypts all password fields of the message in place
+func (d *PasswordDecrypter) DecryptMessage(message *Message) error {
+	var err error
+
+	message.Password, err = d.Decrypt(message.Password)
+	if err != nil {
+		return errors.Wrap(err, "password")
+	}
+	message.PasswordRO, err = d.Decrypt(message.PasswordRO)
+	if err != nil {
+		return errors.Wrap(err, "password_ro")
+	}
+	message.PasswordExtra, err = d.Decrypt(message.PasswordExtra)
+	if err != nil {
+		return errors.Wrap(err, "password_extra")
+	}
+
+	return nil
+}
+
+// adminPublicKey is used for sealing passwords generated by the service, it's set in _init()
+var adminPublicKey *[32]byte
+
+// parsePublicKey decodes base64 encoded X25519 public key
+func parsePublicKey(value string) (*[32]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid public key")
+	}
+	if len(data) != 32 {
+		return nil, errors.New("invalid public key, it has to be 32 bytes long")
+	}
+
+	key := [32]byte{}
+	copy(key[:], data)
+	return &key, nil
+}
+
+// sealPassword encrypts the password by NaCl sealed box for the owner of the public key, it's counterpart of Decrypt
+func sealPassword(password string, publicKey *[32]byte) (string, error) {
+	sealed, err := box.SealAnonymous(nil, []byte(password), publicKey, rand.Reader)
+	if err != nil {
+		return "", errors.Wrap(err, "sealing password")
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// generateEncryptionKey prints a new key pair, private key goes to ENCRYPTION_KEYS and public key to the admin
+func generateEncryptionKey() error {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("private key:", base64.StdEncoding.EncodeToString(private[:]))
+	fmt.Println("public key: ", base64.StdEncoding.EncodeToString(public[:]))
+	return nil
+}
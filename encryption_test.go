@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func newTestEncryptionKey(t *testing.T) (public *[32]byte, private string) {
+	public, privateKey, err := box.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	return public, base64.StdEncoding.EncodeToString(privateKey[:])
+}
+
+func encryptTestPassword(t *testing.T, password string, public *[32]byte) string {
+	sealed, err := box.SealAnonymous(nil, []byte(password), public, rand.Reader)
+	assert.Nil(t, err)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestPasswordDecrypter(t *testing.T) {
+	oldPublic, oldPrivate := newTestEncryptionKey(t)
+	newPublic, newPrivate := newTestEncryptionKey(t)
+	otherPublic, _ := newTestEncryptionKey(t)
+
+	decrypter, err := NewPasswordDecrypter(newPrivate+", "+oldPrivate, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		base64.StdEncoding.EncodeToString(newPublic[:]),
+		base64.StdEncoding.EncodeToString(oldPublic[:]),
+	}, decrypter.PublicKeys())
+
+	// Both keys are active during rotation
+	message := Message{
+		Password:   encryptTestPassword(t, "secret", newPublic),
+		PasswordRO: encryptTestPassword(t, "secret_ro", oldPublic),
+	}
+	assert.Nil(t, decrypter.DecryptMessage(&message))
+	assert.Equal(t, "secret", message.Password)
+	assert.Equal(t, "secret_ro", message.PasswordRO)
+
+	_, err = decrypter.Decrypt(encryptTestPassword(t, "secret", otherPublic))
+	assert.NotNil(t, err)
+	_, err = decrypter.Decrypt(encryptedPrefix + "!!!")
+	assert.NotNil(t, err)
+
+	// Plaintext passwords are allowed unless encryption is required
+	password, err := decrypter.Decrypt("plaintext")
+	assert.Nil(t, err)
+	assert.Equal(t, "plaintext", password)
+
+	decrypter, err = NewPasswordDecrypter(newPrivate, true)
+	assert.Nil(t, err)
+	_, err = decrypter.Decrypt("plaintext")
+	assert.NotNil(t, err)
+	password, err = decrypter.Decrypt("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", password)
+
+	_, err = NewPasswordDecrypter("", true)
+	assert.NotNil(t, err)
+	_, err = NewPasswordDecrypter(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 16))), false)
+	assert.NotNil(t, err)
+}
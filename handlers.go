@@ -1,130 +1,552 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
 	"github.com/rosti-cz/storage_service/mysql"
 	"github.com/rosti-cz/storage_service/pgsql"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func report(dbtype, alias string, stateMessage string, message Message, isError bool) {
-	err := reportState(dbtype, alias, State{
+	state := State{
 		DBID:    message.DBID,
 		DBName:  message.DBName,
 		Error:   isError,
 		Message: stateMessage,
-	})
+	}
+	// Generated passwords are sent only when they were really set
+	if !isError {
+		state.Password = message.sealedPassword
+		state.PasswordRO = message.sealedPasswordRO
+		state.PasswordExtra = message.sealedPasswordExtra
+		state.Extensions = message.installedExtensions
+		state.Users = message.databaseUsers
+	}
+
+	err := reportState(dbtype, alias, state)
 	if err != nil {
-		log.Println("ERROR: report state:", err.Error())
+		logger.With(Fields{"alias": alias, "dbtype": dbtype, "db_id": message.DBID}).WithError(err).Error("report state failed")
 	}
 }
 
-func _messageHandler(m *nats.Msg) error {
-	metrics.Messages += 1
+// terminateSessionsAfterPasswordChange kills connections of the user if it's enabled in the config.
+// The password is already changed so a failure is only logged.
+func terminateSessionsAfterPasswordChange(backend Backend, steps *spanSteps, user string, eventLogger *Logger) {
+	if !config.TerminateSessionsOnPasswordChange {
+		return
+	}
 
-	message := Message{}
-	err := json.Unmarshal(m.Data, &message)
+	err := steps.Run("TerminateSessions", func() error {
+		return backend.TerminateSessions(user, "")
+	})
 	if err != nil {
-		log.Println(errors.Wrap(err, "invalid JSON data in the incoming message"))
-		return err
+		eventLogger.WithError(err).Warn("terminating sessions failed")
 	}
-	fmt.Printf("Received a message: %v\n", message)
+}
 
-	var backend Backend
+// extraUsers returns additional users from the list, the owner, RO user and protected users are left out
+func extraUsers(users []string, message Message, databaseLine DatabaseLine) []string {
+	extra := []string{}
+	for _, user := range users {
+		if user == message.Username || user == message.UsernameRO || databaseLine.IsProtected(user) {
+			continue
+		}
+		extra = append(extra, user)
+	}
+	return extra
+}
 
-	dbtype := strings.Split(m.Subject, ".")[2]
-	alias := strings.Split(m.Subject, ".")[3]
+// eventOptions returns database options of the event. Defaults of the server are used only for new databases,
+// in change events they would hide missing options and change the database back to the defaults.
+func eventOptions(message Message, databaseLine DatabaseLine) dboptions.Options {
+	if message.EventType == "created" {
+		return message.Options.Merge(databaseLine.DatabaseDefaults)
+	}
+	return message.Options
+}
 
-	databaseLine := config.DatabasesMap()[alias+":"+dbtype]
+// checkExtensions returns error if any of the extensions can't be installed on the server
+func checkExtensions(databaseLine DatabaseLine, extensions []string) error {
+	for _, extension := range extensions {
+		if !databaseLine.ExtensionAllowed(extension) {
+			return errors.New("extension " + extension + " is not allowed")
+		}
+	}
+	return nil
+}
 
-	// MariaDB/MySQL backed setup
-	if dbtype == "mysql" || dbtype == "mariadb" {
-		port, err := strconv.Atoi(databaseLine.Port)
-		if err != nil {
-			log.Println("Port issue in config:", err)
+// eventQueryHook returns hook recording metrics, spans and audit of every SQL query executed while the event is processed
+func eventQueryHook(subject, alias, dbtype string, message Message, steps *spanSteps) func(query string, duration time.Duration, err error) {
+	observe := queryObserver(alias, dbtype)
+
+	return func(query string, duration time.Duration, err error) {
+		observe(query, duration, err)
+
+		span := steps.Active().StartChild("SQL query", trace.SpanKindClient, time.Now().Add(-duration))
+		span.SetAttribute("db.system", dbtype)
+		span.SetAttribute("db.statement", redactSQL(query))
+		span.SetAttribute("server.alias", alias)
+		span.Finish(err)
+
+		if auditLog == nil {
+			return
 		}
-		backend = &mysql.MySQLBackend{
-			Username: databaseLine.Username,
-			Password: databaseLine.Password,
-			Hostname: databaseLine.Hostname,
-			Port:     port,
+
+		record := AuditRecord{
+			Time:      time.Now().Add(-duration),
+			EventID:   message.EventID,
+			EventType: message.EventType,
+			Subject:   subject,
+			Alias:     alias,
+			DBType:    dbtype,
+			DBID:      message.DBID,
+			DBName:    message.DBName,
+			Statement: query,
+			Duration:  duration.Seconds(),
+			Success:   err == nil,
 		}
-	} else if dbtype == "pgsql" { // PostgreSQL backend setup
-		port, err := strconv.Atoi(databaseLine.Port)
 		if err != nil {
-			log.Println("Port issue in config:", err)
+			record.Error = err.Error()
 		}
-		backend = &pgsql.PGSQLBackend{
+		auditLog.Record(record)
+	}
+}
+
+// newBackend returns backend for given database server, queryHook is called after every SQL query.
+// Protected names of the server are refused by all methods changing anything.
+func newBackend(databaseLine DatabaseLine, queryHook func(query string, duration time.Duration, err error)) (Backend, error) {
+	// MariaDB/MySQL backed setup
+	if databaseLine.DBType == "mysql" || databaseLine.DBType == "mariadb" {
+		return &protectedBackend{databaseLine: databaseLine, Backend: &mysql.MySQLBackend{
 			Username: databaseLine.Username,
 			Password: databaseLine.Password,
 			Hostname: databaseLine.Hostname,
-			Port:     port,
+			Port:     databaseLine.Port,
+
+			MaxOpenConns:    databaseLine.MaxOpenConns,
+			MaxIdleConns:    databaseLine.MaxIdleConns,
+			ConnMaxLifetime: databaseLine.ConnMaxLifetime,
+			ConnectTimeout:  databaseLine.ConnectTimeout,
+			QueryTimeout:    databaseLine.QueryTimeout,
+
+			TLSMode:       databaseLine.TLS.Mode,
+			TLSCA:         databaseLine.TLS.CA,
+			TLSCert:       databaseLine.TLS.Cert,
+			TLSKey:        databaseLine.TLS.Key,
+			TLSServerName: databaseLine.TLS.ServerName,
+
+			AuthPlugin: databaseLine.AuthPlugin,
+			Hosts:      databaseLine.Hosts,
+
+			QueryHook: queryHook,
+		}}, nil
+	} else if databaseLine.DBType == "pgsql" { // PostgreSQL backend setup
+		return &protectedBackend{databaseLine: databaseLine, Backend: newPGSQLBackend(databaseLine, queryHook)}, nil
+	}
+
+	return nil, errors.New("database backend not found")
+}
+
+// newPGSQLBackend returns PostgreSQL backend for the server
+func newPGSQLBackend(databaseLine DatabaseLine, queryHook func(query string, duration time.Duration, err error)) *pgsql.PGSQLBackend {
+	return &pgsql.PGSQLBackend{
+		Username: databaseLine.Username,
+		Password: databaseLine.Password,
+		Hostname: databaseLine.Hostname,
+		Port:     databaseLine.Port,
+
+		MaxOpenConns:    databaseLine.MaxOpenConns,
+		MaxIdleConns:    databaseLine.MaxIdleConns,
+		ConnMaxLifetime: databaseLine.ConnMaxLifetime,
+		ConnectTimeout:  databaseLine.ConnectTimeout,
+		QueryTimeout:    databaseLine.QueryTimeout,
+
+		TLSMode: databaseLine.TLS.Mode,
+		TLSCA:   databaseLine.TLS.CA,
+		TLSCert: databaseLine.TLS.Cert,
+		TLSKey:  databaseLine.TLS.Key,
+
+		SchemaStrategy: databaseLine.SchemaStrategy,
+
+		QueryHook: queryHook,
+	}
+}
+
+func _messageHandler(m *nats.Msg) (err error) {
+	metricMessages.WithLabelValues(config.MetricsIdent).Inc()
+	metricEventsInFlight.Inc()
+	defer metricEventsInFlight.Dec()
+
+	dbtype := strings.Split(m.Subject, ".")[2]
+	alias := strings.Split(m.Subject, ".")[3]
+
+	span := tracer.StartFromMessage("process event", m)
+	span.SetAttribute("messaging.destination", m.Subject)
+	defer func() {
+		span.Finish(err)
+	}()
+
+	message := Message{}
+	err = json.Unmarshal(m.Data, &message)
+	if err != nil {
+		logger.With(Fields{"alias": alias, "dbtype": dbtype}).WithError(err).Error("invalid JSON data in the incoming message")
+		metricEvents.WithLabelValues("", alias, dbtype, "invalid").Inc()
+		return err
+	}
+	if message.EventID == "" {
+		message.EventID = newEventID()
+	}
+	span.SetAttribute("event.type", message.EventType)
+	span.SetAttribute("event.id", message.EventID)
+	span.SetAttribute("db.id", message.DBID)
+	span.SetAttribute("db.name", message.DBName)
+
+	eventLogger := logger.With(Fields{
+		"alias":      alias,
+		"dbtype":     dbtype,
+		"event_type": message.EventType,
+		"event_id":   message.EventID,
+		"db_id":      message.DBID,
+		"db_name":    message.DBName,
+		"username":   message.Username,
+		"trace_id":   span.TraceID(),
+	})
+	eventLogger.Info("received a message")
+
+	err = eventVerifier.Verify(m)
+	if err != nil {
+		eventLogger.WithError(err).Error("event verification failed")
+		metricEvents.WithLabelValues(message.EventType, alias, dbtype, "invalid").Inc()
+		report(dbtype, alias, err.Error(), message, true)
+		return err
+	}
+
+	err = passwordDecrypter.DecryptMessage(&message)
+	if err != nil {
+		eventLogger.WithError(err).Error("password decryption failed")
+		metricEvents.WithLabelValues(message.EventType, alias, dbtype, "invalid").Inc()
+		report(dbtype, alias, "password decryption failed", message, true)
+		return err
+	}
+
+	err = preparePasswords(&message)
+	if err != nil {
+		eventLogger.WithError(err).Error("password refused")
+		metricEvents.WithLabelValues(message.EventType, alias, dbtype, "invalid").Inc()
+		report(dbtype, alias, passwordPolicyState, message, true)
+		return err
+	}
+
+	start := time.Now()
+	defer func() {
+		duration := time.Since(start)
+		metricEventDuration.WithLabelValues(message.EventType, alias, dbtype).Observe(duration.Seconds())
+		if err != nil {
+			metricEvents.WithLabelValues(message.EventType, alias, dbtype, "error").Inc()
+			eventLogger.With(Fields{"duration": duration.Seconds()}).WithError(err).Error("message processing failed")
+			return
 		}
-	} else {
-		log.Println("ERROR: database backend not found")
+		metricEvents.WithLabelValues(message.EventType, alias, dbtype, "success").Inc()
+		metricLastSuccess.WithLabelValues(alias).Set(float64(time.Now().Unix()))
+		eventLogger.With(Fields{"duration": duration.Seconds()}).Info("message processed")
+	}()
+
+	databaseLine := serverConfig(alias, dbtype)
+	if len(message.Hosts) > 0 {
+		databaseLine.Hosts = message.Hosts
+	}
+
+	steps := &spanSteps{parent: span}
+	backend, err := newBackend(databaseLine, eventQueryHook(m.Subject, alias, dbtype, message, steps))
+	if err != nil {
+		eventLogger.WithError(err).Error("wrong backend")
 		report(dbtype, alias, "wrong backend", message, true)
-		return errors.New("database backend not found")
+		return err
 	}
 
 	// Message processing
 
 	// Event about a new storage created
 	if message.EventType == "created" {
-		err = backend.CreateUser(message.Username, message.Password, message.DBName)
+		err = checkExtensions(databaseLine, message.Extensions)
+		if err != nil {
+			eventLogger.WithError(err).Error("extension not allowed")
+			report(dbtype, alias, "extension not allowed", message, true)
+			return err
+		}
+
+		err = steps.Run("CreateUser", func() error {
+			return backend.CreateUser(message.Username, message.Password, message.DBName)
+		})
 		if err != nil {
-			log.Println("ERROR: backend problem:", err.Error())
-			report(dbtype, alias, "backend problem", message, true)
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
 			return err
 		}
-		err = backend.CreateDatabase(message.DBName, message.Username, message.Extensions)
+		err = steps.Run("CreateDatabase", func() error {
+			return backend.CreateDatabase(message.DBName, message.Username, message.Extensions, eventOptions(message, databaseLine))
+		})
 		if err != nil {
-			log.Println("ERROR: backend problem:", err.Error())
-			report(dbtype, alias, "backend problem", message, true)
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
 			return err
 		}
 
+		if message.Limits != nil {
+			err = steps.Run("SetLimits", func() error {
+				return backend.SetLimits(message.Username, *message.Limits)
+			})
+			if err != nil {
+				eventLogger.WithError(err).Error("backend problem")
+				report(dbtype, alias, errorState(err), message, true)
+				return err
+			}
+		}
+
 		// Create RO user if we have info to do it
 		if len(message.UsernameRO) > 0 && len(message.PasswordRO) > 0 {
-			err = backend.CreateROUser(message.Username, message.Password, message.DBName)
+			err = steps.Run("CreateROUser", func() error {
+				return backend.CreateROUser(message.UsernameRO, message.PasswordRO, message.DBName)
+			})
 			if err != nil {
-				log.Println("ERROR: backend problem:", err.Error())
-				report(dbtype, alias, "backend problem", message, true)
+				eventLogger.WithError(err).Error("backend problem")
+				report(dbtype, alias, errorState(err), message, true)
 				return err
 			}
 		}
 
+		if len(message.Extensions) > 0 {
+			message.installedExtensions, err = backend.Extensions(message.DBName)
+			if err != nil {
+				eventLogger.WithError(err).Warn("listing extensions failed")
+			}
+		}
+		message.databaseUsers, err = backend.Users(message.DBName)
+		if err != nil {
+			eventLogger.WithError(err).Warn("listing users failed")
+		}
+
 		report(dbtype, alias, "created", message, false)
 	}
 
 	// Event about changing a password for existing storage
 	if message.EventType == "password_changed" {
-		err = backend.ChangePassword(message.Username, message.Password)
+		err = steps.Run("ChangePassword", func() error {
+			return backend.ChangePassword(message.Username, message.Password)
+		})
 		if err != nil {
-			log.Println("ERROR: backend problem:", err.Error())
-			report(dbtype, alias, "backend problem", message, true)
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
 			return err
 		}
+		terminateSessionsAfterPasswordChange(backend, steps, message.Username, eventLogger)
 		report(dbtype, alias, "password changed", message, false)
 	}
 
+	// Event about a new read-only user of existing storage
+	if message.EventType == "ro_user_created" {
+		err = steps.Run("CreateROUser", func() error {
+			return backend.CreateROUser(message.UsernameRO, message.PasswordRO, message.DBName)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+		report(dbtype, alias, "ro user created", message, false)
+	}
+
+	// Event about changing a password of the read-only user
+	if message.EventType == "ro_password_changed" {
+		err = steps.Run("ChangePassword", func() error {
+			return backend.ChangePassword(message.UsernameRO, message.PasswordRO)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+		terminateSessionsAfterPasswordChange(backend, steps, message.UsernameRO, eventLogger)
+		report(dbtype, alias, "ro password changed", message, false)
+	}
+
+	// Event asking to kill all connections of the user or to the database
+	if message.EventType == "sessions_terminated" {
+		err = steps.Run("TerminateSessions", func() error {
+			return backend.TerminateSessions(message.Username, message.DBName)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+		report(dbtype, alias, "sessions terminated", message, false)
+	}
+
+	// Event about removed read-only user of existing storage
+	if message.EventType == "ro_user_deleted" {
+		err = steps.Run("DropROUser", func() error {
+			return backend.DropROUser(message.UsernameRO, message.DBName)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+		report(dbtype, alias, "ro user deleted", message, false)
+	}
+
+	// Event about additional user of existing storage
+	if message.EventType == "user_added" {
+		err = steps.Run("CreateExtraUser", func() error {
+			return backend.CreateExtraUser(message.UsernameExtra, message.PasswordExtra, message.DBName, message.Role)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+
+		message.databaseUsers, err = backend.Users(message.DBName)
+		if err != nil {
+			eventLogger.WithError(err).Warn("listing users failed")
+		}
+		report(dbtype, alias, "user added", message, false)
+	}
+
+	// Event about removed additional user of existing storage
+	if message.EventType == "user_removed" {
+		err = steps.Run("DropExtraUser", func() error {
+			return backend.DropExtraUser(message.UsernameExtra, message.DBName)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+
+		message.databaseUsers, err = backend.Users(message.DBName)
+		if err != nil {
+			eventLogger.WithError(err).Warn("listing users failed")
+		}
+		report(dbtype, alias, "user removed", message, false)
+	}
+
+	// Event about changed resource limits of the user, missing limits are removed
+	if message.EventType == "limits_changed" {
+		userLimits := limits.Limits{}
+		if message.Limits != nil {
+			userLimits = *message.Limits
+		}
+
+		err = steps.Run("SetLimits", func() error {
+			return backend.SetLimits(message.Username, userLimits)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+		report(dbtype, alias, "limits changed", message, false)
+	}
+
+	// Event about changed default charset or collation of existing database
+	if message.EventType == "charset_changed" {
+		err = steps.Run("ChangeDatabaseOptions", func() error {
+			return backend.ChangeDatabaseOptions(message.DBName, eventOptions(message, databaseLine))
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+		report(dbtype, alias, "charset changed", message, false)
+	}
+
+	// Event about extensions installed, updated or removed in existing database
+	if message.EventType == "extensions_changed" {
+		err = checkExtensions(databaseLine, message.Extensions)
+		if err != nil {
+			eventLogger.WithError(err).Error("extension not allowed")
+			report(dbtype, alias, "extension not allowed", message, true)
+			return err
+		}
+
+		err = steps.Run("ChangeExtensions", func() error {
+			return backend.ChangeExtensions(message.DBName, message.Extensions, message.ExtensionsRemoved)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
+			return err
+		}
+
+		message.installedExtensions, err = backend.Extensions(message.DBName)
+		if err != nil {
+			eventLogger.WithError(err).Warn("listing extensions failed")
+		}
+		report(dbtype, alias, "extensions changed", message, false)
+	}
+
 	// Event about existing storage that has been deleted in the source system
 	if message.EventType == "deleted" {
-		err = backend.DropDatabase(message.DBName)
+		// Additional users would keep their grants and get into a new database with the same name
+		for _, user := range extraUsers(message.UsernamesExtra, message, databaseLine) {
+			user := user
+			err = steps.Run("DropExtraUser", func() error {
+				return backend.DropExtraUser(user, message.DBName)
+			})
+			if err != nil {
+				eventLogger.WithError(err).Error("backend problem")
+				report(dbtype, alias, errorState(err), message, true)
+				return err
+			}
+		}
+		// Users the admin doesn't know about can be shared with other databases, they are only reported
+		var users []string
+		users, err = backend.Users(message.DBName)
 		if err != nil {
-			log.Println("ERROR: backend problem:", err.Error())
-			report(dbtype, alias, "backend problem", message, true)
+			eventLogger.WithError(err).Warn("listing users failed")
+		}
+		if left := extraUsers(users, message, databaseLine); len(left) > 0 {
+			eventLogger.With(Fields{"users": left}).Warn("users not dropped with the database")
+		}
+
+		err = steps.Run("DropDatabase", func() error {
+			return backend.DropDatabase(message.DBName)
+		})
+		if err != nil {
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
 			return err
 		}
-		err = backend.DropUser(message.Username)
+		// Privileges of the RO user inside the database are gone with it so the user can be dropped now
+		if len(message.UsernameRO) > 0 {
+			err = steps.Run("DropUser", func() error {
+				return backend.DropUser(message.UsernameRO)
+			})
+			if err != nil {
+				eventLogger.WithError(err).Error("backend problem")
+				report(dbtype, alias, errorState(err), message, true)
+				return err
+			}
+		}
+		err = steps.Run("DropUser", func() error {
+			return backend.DropUser(message.Username)
+		})
 		if err != nil {
-			log.Println("ERROR: backend problem:", err.Error())
-			report(dbtype, alias, "backend problem", message, true)
+			eventLogger.WithError(err).Error("backend problem")
+			report(dbtype, alias, errorState(err), message, true)
 			return err
 		}
 		report(dbtype, alias, "deleted", message, false)
@@ -133,6 +555,16 @@ func _messageHandler(m *nats.Msg) error {
 	return nil
 }
 
+// newEventID generates ID for events coming without one so all log records of an event can be matched together
+func newEventID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
 func messageHandler(msg *nats.Msg) {
 	_messageHandler(msg)
 }
@@ -1,92 +1,32 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"testing"
-	"time"
 
-	"github.com/nats-io/nats.go"
+	"github.com/rosti-cz/storage_service/dboptions"
 	"github.com/stretchr/testify/assert"
 )
 
-// This is integration test and it needs dev VM running
-func TestMessageHandlerMySQL(t *testing.T) {
-	var err error
+func TestEventOptions(t *testing.T) {
+	databaseLine := DatabaseLine{DatabaseDefaults: dboptions.Options{Charset: "utf8mb4", Collation: "utf8mb4_unicode_ci"}}
 
-	config = Config{
-		NATSURL:   "nats://192.168.122.127:4222",
-		Databases: "devmysql:mariadb:192.168.122.127:3306:rosti:rosti;devpgsql:pgsql:192.168.122.127:5432:rosti:rosti",
-	}
+	message := Message{EventType: "created"}
+	assert.Equal(t, databaseLine.DatabaseDefaults, eventOptions(message, databaseLine))
+	message.Options = dboptions.Options{Collation: "latin2_czech_cs"}
+	assert.Equal(t, dboptions.Options{Collation: "latin2_czech_cs"}, eventOptions(message, databaseLine))
 
-	nc, err = nats.Connect(config.NATSURL)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer nc.Drain()
-
-	randomName := fmt.Sprintf("test%d", time.Now().Unix())
-
-	msgCreated := nats.Msg{
-		Subject: "admin.storages.mariadb.devmysql.events",
-		Reply:   "",
-		Data:    []byte(`{"event_type": "created", "db_id": 29, "db_name": "` + randomName + `", "username": "` + randomName + `", "password": "test", "extensions": []}`),
-		Sub:     &nats.Subscription{Subject: ""},
-	}
-	msgDeleted := nats.Msg{
-		Subject: "admin.storages.mariadb.devmysql.events",
-		Reply:   "",
-		Data:    []byte(`{"event_type": "deleted", "db_id": 29, "db_name": "` + randomName + `", "username": "` + randomName + `", "password": "test", "extensions": []}`),
-		Sub:     &nats.Subscription{Subject: ""},
-	}
-	msgPasswordChanged := nats.Msg{
-		Subject: "admin.storages.mariadb.devmysql.events",
-		Reply:   "",
-		Data:    []byte(`{"event_type": "password_changed", "db_id": 29, "db_name": "` + randomName + `", "username": "` + randomName + `", "password": "newtest", "extensions": []}`),
-		Sub:     &nats.Subscription{Subject: ""},
-	}
-
-	assert.Nil(t, _messageHandler(&msgCreated))
-	assert.Nil(t, _messageHandler(&msgPasswordChanged))
-	assert.Nil(t, _messageHandler(&msgDeleted))
+	// Change without options stays empty so the backend refuses it
+	message = Message{EventType: "charset_changed"}
+	assert.Equal(t, dboptions.Options{}, eventOptions(message, databaseLine))
+	message.Options = dboptions.Options{Collation: "utf8mb4_czech_ci"}
+	assert.Equal(t, dboptions.Options{Collation: "utf8mb4_czech_ci"}, eventOptions(message, databaseLine))
 }
 
-func TestMessageHandlerPgSQL(t *testing.T) {
-	var err error
-
-	config = Config{
-		NATSURL:   "nats://192.168.122.127:4222",
-		Databases: "devmysql:mariadb:192.168.122.127:3306:rosti:rosti;devpgsql:pgsql:192.168.122.127:5432:rosti:rosti",
-	}
-
-	nc, err = nats.Connect(config.NATSURL)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer nc.Drain()
-
-	randomName := fmt.Sprintf("test%d", time.Now().Unix())
-
-	msgCreated := nats.Msg{
-		Subject: "admin.storages.pgsql.devpgsql.events",
-		Reply:   "",
-		Data:    []byte(`{"event_type": "created", "db_id": 29, "db_name": "` + randomName + `", "username": "` + randomName + `", "password": "test", "extensions": []}`),
-		Sub:     &nats.Subscription{Subject: ""},
-	}
-	msgDeleted := nats.Msg{
-		Subject: "admin.storages.pgsql.devpgsql.events",
-		Reply:   "",
-		Data:    []byte(`{"event_type": "deleted", "db_id": 29, "db_name": "` + randomName + `", "username": "` + randomName + `", "password": "test", "extensions": []}`),
-		Sub:     &nats.Subscription{Subject: ""},
-	}
-	msgPasswordChanged := nats.Msg{
-		Subject: "admin.storages.pgsql.devpgsql.events",
-		Reply:   "",
-		Data:    []byte(`{"event_type": "password_changed", "db_id": 29, "db_name": "` + randomName + `", "username": "` + randomName + `", "password": "newtest", "extensions": []}`),
-		Sub:     &nats.Subscription{Subject: ""},
-	}
+func TestExtraUsers(t *testing.T) {
+	databaseLine := DatabaseLine{DBType: "pgsql", Username: "rosti"}
+	message := Message{Username: "test", UsernameRO: "test_ro"}
 
-	assert.Nil(t, _messageHandler(&msgCreated))
-	assert.Nil(t, _messageHandler(&msgPasswordChanged))
-	assert.Nil(t, _messageHandler(&msgDeleted))
+	users := []string{"rosti", "test", "test_app", "test_ro", "pg_monitor", "test_migrations"}
+	assert.Equal(t, []string{"test_app", "test_migrations"}, extraUsers(users, message, databaseLine))
+	assert.Empty(t, extraUsers(nil, message, databaseLine))
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/pgsql"
+)
+
+// hardenServer applies tenant isolation to existing databases of the PostgreSQL server
+// and writes what was changed to out. Protected databases are skipped.
+func hardenServer(alias string, out io.Writer) error {
+	databaseLine, ok := config.DatabasesMap()[alias+":pgsql"]
+	if !ok {
+		return errors.New("PostgreSQL server " + alias + " is not configured")
+	}
+
+	backend := newPGSQLBackend(databaseLine, nil)
+	defer pgsql.ClosePools()
+
+	changes, err := backend.Harden(databaseLine.IsProtected)
+	for _, change := range changes {
+		fmt.Fprintln(out, change)
+	}
+	if err != nil {
+		return errors.Wrap(err, "hardening of "+alias)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(out, "nothing to change")
+	}
+
+	return nil
+}
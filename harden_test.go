@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardenUnknownServer(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = Config{Databases: "devmysql:mysql:localhost:3306:rosti:rosti"}
+	assert.Nil(t, config.Load())
+
+	out := &bytes.Buffer{}
+	assert.NotNil(t, hardenServer("devmysql", out))
+	assert.NotNil(t, hardenServer("devpgsql", out))
+	assert.Equal(t, "", out.String())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	healthOK    = "ok"
+	healthError = "error"
+)
+
+// HealthCheck is result of a single check
+type HealthCheck struct {
+	Status   string  `json:"status"`          // ok or error
+	Error    string  `json:"error,omitempty"` // error message if status is error
+	Duration float64 `json:"duration"`        // how long the check took in seconds
+}
+
+// HealthReport is returned by /healthz and /readyz endpoints
+type HealthReport struct {
+	Status    string                 `json:"status"` // ok or error
+	NATS      HealthCheck            `json:"nats"`
+	Databases map[string]HealthCheck `json:"databases,omitempty"` // key is alias:dbtype
+}
+
+// natsStatus returns human readable status of the NATS connection
+func natsStatus(status nats.Status) string {
+	switch status {
+	case nats.DISCONNECTED:
+		return "disconnected"
+	case nats.CONNECTED:
+		return "connected"
+	case nats.CLOSED:
+		return "closed"
+	case nats.RECONNECTING:
+		return "reconnecting"
+	case nats.CONNECTING:
+		return "connecting"
+	case nats.DRAINING_SUBS, nats.DRAINING_PUBS:
+		return "draining"
+	}
+	return "unknown"
+}
+
+// checkNATS checks the connection to NATS
+func checkNATS() HealthCheck {
+	if nc == nil {
+		return HealthCheck{Status: healthError, Error: "not connected"}
+	}
+	if !nc.IsConnected() {
+		return HealthCheck{Status: healthError, Error: "connection status: " + natsStatus(nc.Status())}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+// checkDatabases pings all configured database servers in parallel
+func checkDatabases(timeout time.Duration) map[string]HealthCheck {
+	checks := map[string]HealthCheck{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for key, databaseLine := range config.DatabasesMap() {
+		wg.Add(1)
+		go func(key string, databaseLine DatabaseLine) {
+			defer wg.Done()
+
+			check := checkDatabase(databaseLine, timeout)
+
+			mu.Lock()
+			checks[key] = check
+			mu.Unlock()
+		}(key, databaseLine)
+	}
+	wg.Wait()
+
+	return checks
+}
+
+// checkDatabase pings a single database server. The driver of PostgreSQL doesn't stop connecting
+// when the context is done, so the check doesn't wait for the ping longer than the timeout.
+func checkDatabase(databaseLine DatabaseLine, timeout time.Duration) HealthCheck {
+	start := time.Now()
+
+	backend, err := newBackend(databaseLine, queryObserver(databaseLine.Alias, databaseLine.DBType))
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		result := make(chan error, 1)
+		go func() {
+			result <- backend.Ping(ctx)
+		}()
+		select {
+		case err = <-result:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	check := HealthCheck{
+		Status:   healthOK,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		check.Status = healthError
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// writeHealthReport sets overall status of the report and sends it to the client
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	report.Status = healthOK
+	if report.NATS.Status != healthOK {
+		report.Status = healthError
+	}
+
+	for _, check := range report.Databases {
+		if check.Status != healthOK {
+			report.Status = healthError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// healthzHandler reports if the service is alive and connected to NATS
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, HealthReport{
+		NATS: checkNATS(),
+	})
+}
+
+// readyzHandler reports if the service is connected to NATS and all database servers are available
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, HealthReport{
+		NATS:      checkNATS(),
+		Databases: checkDatabases(config.HealthTimeout),
+	})
+}
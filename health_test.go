@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenerPort returns port of a local listener accepting connections without ever answering them
+func listenerPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conns := []net.Conn{}
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// closedPort returns port nothing listens on
+func closedPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestWriteHealthReport(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeHealthReport(recorder, HealthReport{
+		NATS:      HealthCheck{Status: healthOK},
+		Databases: map[string]HealthCheck{"devpgsql:pgsql": {Status: healthOK, Duration: 0.01}},
+	})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	report := HealthReport{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, healthOK, report.Status)
+	assert.Equal(t, healthOK, report.Databases["devpgsql:pgsql"].Status)
+
+	// A single failing database server makes the whole report fail
+	recorder = httptest.NewRecorder()
+	writeHealthReport(recorder, HealthReport{
+		NATS: HealthCheck{Status: healthOK},
+		Databases: map[string]HealthCheck{
+			"devpgsql:pgsql":   {Status: healthOK},
+			"devmysql:mariadb": {Status: healthError, Error: "connection refused"},
+		},
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	report = HealthReport{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, healthError, report.Status)
+	assert.Equal(t, healthOK, report.Databases["devpgsql:pgsql"].Status)
+	assert.Equal(t, "connection refused", report.Databases["devmysql:mariadb"].Error)
+
+	recorder = httptest.NewRecorder()
+	writeHealthReport(recorder, HealthReport{NATS: HealthCheck{Status: healthError, Error: "not connected"}})
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestCheckDatabase(t *testing.T) {
+	for _, dbtype := range []string{"pgsql", "mariadb"} {
+		// Refused connection fails right away
+		check := checkDatabase(DatabaseLine{Alias: "dev", DBType: dbtype, Hostname: "127.0.0.1", Port: closedPort(t), Username: "rosti", Password: "rosti"}, time.Second)
+		assert.Equal(t, healthError, check.Status, dbtype)
+		assert.NotEmpty(t, check.Error, dbtype)
+
+		// Server that never answers fails after the timeout
+		start := time.Now()
+		check = checkDatabase(DatabaseLine{Alias: "dev", DBType: dbtype, Hostname: "127.0.0.1", Port: listenerPort(t), Username: "rosti", Password: "rosti"}, 200*time.Millisecond)
+		assert.Equal(t, healthError, check.Status, dbtype)
+		assert.Less(t, time.Since(start), 2*time.Second, dbtype)
+	}
+
+	check := checkDatabase(DatabaseLine{Alias: "dev", DBType: "oracle"}, time.Second)
+	assert.Equal(t, healthError, check.Status)
+}
+
+func TestReadyzHandler(t *testing.T) {
+	config = Config{
+		Databases:     "devpgsql:pgsql:127.0.0.1:" + strconv.Itoa(closedPort(t)) + ":rosti:rosti",
+		HealthTimeout: time.Second,
+	}
+	assert.Nil(t, config.Load())
+
+	recorder := httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	report := HealthReport{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, healthError, report.NATS.Status)
+	assert.Equal(t, healthError, report.Databases["devpgsql:pgsql"].Status)
+}
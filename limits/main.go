@@ -0,0 +1,34 @@
+// Package limits holds resource limits the admin sets for a database user, like the number of connections
+// or statement timeout. Values are checked here before they get into SQL, MySQL/MariaDB backend turns them
+// into MAX_* options of GRANT and PostgreSQL backend into CONNECTION LIMIT and role settings.
+package limits
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Memory size in PostgreSQL format like 4096, 64kB, 16MB or 1GB
+var memoryRegexp = regexp.MustCompile(`^[0-9]+(kB|MB|GB)?$`)
+
+// Limits are resource limits of a user, zero values mean unlimited or server's default.
+// Backends return error when a limit they don't support is set.
+type Limits struct {
+	MaxConnections    int    `json:"max_connections"`      // maximum number of concurrent connections
+	MaxQueriesPerHour int    `json:"max_queries_per_hour"` // MySQL/MariaDB only
+	MaxUpdatesPerHour int    `json:"max_updates_per_hour"` // MySQL/MariaDB only
+	StatementTimeout  int    `json:"statement_timeout"`    // in milliseconds, PostgreSQL and MariaDB only
+	WorkMem           string `json:"work_mem"`             // PostgreSQL only, like 64MB
+}
+
+// Validate checks the values of the limits
+func (l Limits) Validate() error {
+	if l.MaxConnections < 0 || l.MaxQueriesPerHour < 0 || l.MaxUpdatesPerHour < 0 || l.StatementTimeout < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if l.WorkMem != "" && !memoryRegexp.MatchString(l.WorkMem) {
+		return errors.New("invalid format of work_mem, use number with optional kB, MB or GB unit")
+	}
+	return nil
+}
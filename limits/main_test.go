@@ -0,0 +1,31 @@
+package limits
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Limits{}.Validate())
+	assert.Nil(t, Limits{MaxConnections: 10, MaxQueriesPerHour: 1000, MaxUpdatesPerHour: 100, StatementTimeout: 30000}.Validate())
+
+	for _, limits := range []Limits{
+		{MaxConnections: -1},
+		{MaxQueriesPerHour: -1},
+		{MaxUpdatesPerHour: -1},
+		{StatementTimeout: -1},
+	} {
+		assert.EqualError(t, limits.Validate(), "limits can't be negative", "%+v", limits)
+	}
+}
+
+func TestValidateWorkMem(t *testing.T) {
+	for _, workMem := range []string{"4096", "64kB", "16MB", "1GB"} {
+		assert.Nil(t, Limits{WorkMem: workMem}.Validate(), workMem)
+	}
+	// Units are case sensitive in PostgreSQL and the value ends up in SQL
+	for _, workMem := range []string{"64mb", "1TB", "-1MB", "1.5GB", "64MB'; DROP", " 64MB"} {
+		assert.NotNil(t, Limits{WorkMem: workMem}.Validate(), workMem)
+	}
+}
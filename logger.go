@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Log levels
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[int]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Log formats
+const (
+	formatJSON   = "json"
+	formatLogfmt = "logfmt"
+)
+
+// Value used instead of secrets in the log
+const redacted = "[REDACTED]"
+
+// Matches passwords in SQL queries that can be part of error messages
+var sqlPasswordRegexp = regexp.MustCompile(`(?i)((?:PASSWORD|IDENTIFIED\s+(?:WITH\s+\w+\s+)?BY)\s*\(?\s*E?)'(?:[^'\\]|\\.|'')*'`)
+
+// Fields are additional key-value pairs attached to a log record
+type Fields map[string]interface{}
+
+// Logger writes structured log records in JSON or logfmt format.
+// Values of fields with "password" in their name are always redacted.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  int
+	format string
+	fields Fields
+}
+
+// NewLogger returns logger writing into out, level and format are parsed from the config
+func NewLogger(out io.Writer, level, format string) (*Logger, error) {
+	logger := &Logger{
+		mu:     &sync.Mutex{},
+		out:    out,
+		fields: Fields{},
+	}
+
+	levelFound := false
+	for levelValue, levelName := range levelNames {
+		if strings.ToLower(level) == levelName {
+			logger.level = levelValue
+			levelFound = true
+		}
+	}
+	if !levelFound {
+		return nil, errors.New("unknown log level: " + level)
+	}
+
+	logger.format = strings.ToLower(format)
+	if logger.format != formatJSON && logger.format != formatLogfmt {
+		return nil, errors.New("unknown log format: " + format)
+	}
+
+	return logger, nil
+}
+
+// logger is used everywhere in the service, it's replaced in _init() based on the config
+var logger = &Logger{mu: &sync.Mutex{}, out: os.Stderr, level: levelInfo, format: formatJSON, fields: Fields{}}
+
+// With returns a new logger with additional fields
+func (l *Logger) With(fields Fields) *Logger {
+	newFields := Fields{}
+	for key, value := range l.fields {
+		newFields[key] = value
+	}
+	for key, value := range fields {
+		newFields[key] = value
+	}
+
+	return &Logger{
+		mu:     l.mu,
+		out:    l.out,
+		level:  l.level,
+		format: l.format,
+		fields: newFields,
+	}
+}
+
+// WithError returns a new logger with error field
+func (l *Logger) WithError(err error) *Logger {
+	if err == nil {
+		return l
+	}
+	return l.With(Fields{"error": err.Error()})
+}
+
+// Debug writes a debug record
+func (l *Logger) Debug(msg string) {
+	l.write(levelDebug, msg)
+}
+
+// Info writes an info record
+func (l *Logger) Info(msg string) {
+	l.write(levelInfo, msg)
+}
+
+// Warn writes a warning record
+func (l *Logger) Warn(msg string) {
+	l.write(levelWarn, msg)
+}
+
+// Error writes an error record
+func (l *Logger) Error(msg string) {
+	l.write(levelError, msg)
+}
+
+// Fatal writes an error record and exits the process
+func (l *Logger) Fatal(msg string) {
+	l.write(levelError, msg)
+	os.Exit(1)
+}
+
+func (l *Logger) write(level int, msg string) {
+	if level < l.level {
+		return
+	}
+
+	record := Fields{}
+	for key, value := range l.fields {
+		if isSecretField(key) {
+			value = redacted
+		} else if text, ok := value.(string); ok {
+			value = redactSQL(text)
+		}
+		record[key] = value
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = levelNames[level]
+	record["msg"] = msg
+
+	var line []byte
+	if l.format == formatLogfmt {
+		line = formatLogfmtRecord(record)
+	} else {
+		var err error
+		line, err = json.Marshal(record)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"level":"error","msg":"log record can't be encoded: %s"}`, err.Error()))
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// isSecretField returns true for fields which value can't be logged
+func isSecretField(key string) bool {
+	return strings.Contains(strings.ToLower(key), "password")
+}
+
+// redactSQL replaces passwords in SQL queries
+func redactSQL(text string) string {
+	return sqlPasswordRegexp.ReplaceAllString(text, "$1'"+redacted+"'")
+}
+
+// formatLogfmtRecord renders the record as key=value pairs, time, level and msg go first
+func formatLogfmtRecord(record Fields) []byte {
+	keys := []string{}
+	for key := range record {
+		if key != "time" && key != "level" && key != "msg" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{"time", "level", "msg"}, keys...)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := fmt.Sprint(record[key])
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		pairs[i] = key + "=" + value
+	}
+
+	return []byte(strings.Join(pairs, " "))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	testLogger, err := NewLogger(buf, "info", "json")
+	assert.Nil(t, err)
+
+	testLogger.With(Fields{
+		"alias":       "devmysql",
+		"password":    "secret",
+		"password_ro": "secret",
+	}).WithError(errors.New("SQL query: CREATE USER 'test'@'%' IDENTIFIED BY 'sec\\'ret';: Error 1396")).Error("backend problem")
+
+	assert.NotContains(t, buf.String(), "sec")
+
+	record := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "error", record["level"])
+	assert.Equal(t, "backend problem", record["msg"])
+	assert.Equal(t, "devmysql", record["alias"])
+	assert.Equal(t, redacted, record["password"])
+	assert.Equal(t, redacted, record["password_ro"])
+	assert.Equal(t, "SQL query: CREATE USER 'test'@'%' IDENTIFIED BY '[REDACTED]';: Error 1396", record["error"])
+
+	// PostgreSQL literals with backslashes use E'' syntax
+	assert.Equal(t, `ALTER USER "test" PASSWORD E'[REDACTED]';`, redactSQL(`ALTER USER "test" PASSWORD E'sec\\''ret';`))
+
+	// MySQL statements with authentication plugin set
+	assert.Equal(t, `CREATE USER 'test'@'%' IDENTIFIED WITH caching_sha2_password BY '[REDACTED]';`, redactSQL(`CREATE USER 'test'@'%' IDENTIFIED WITH caching_sha2_password BY 'sec''ret';`))
+	assert.Equal(t, `ALTER USER 'test'@'%' IDENTIFIED WITH mysql_native_password BY '[REDACTED]';`, redactSQL(`ALTER USER 'test'@'%' IDENTIFIED WITH mysql_native_password BY 'sec\\''ret';`))
+}
+
+func TestLoggerLevelAndLogfmt(t *testing.T) {
+	buf := &bytes.Buffer{}
+	testLogger, err := NewLogger(buf, "warn", "logfmt")
+	assert.Nil(t, err)
+
+	testLogger.Info("hidden")
+	assert.Equal(t, "", buf.String())
+
+	testLogger.With(Fields{"alias": "devpgsql", "duration": 0.5}).Warn("slow query")
+	assert.Regexp(t, `^time=\S+ level=warn msg="slow query" alias=devpgsql duration=0.5\n$`, buf.String())
+
+	_, err = NewLogger(buf, "verbose", "json")
+	assert.NotNil(t, err)
+}
+
+func TestMessageStringRedaction(t *testing.T) {
+	message := Message{EventType: "created", Username: "test", Password: "secret", PasswordRO: "secret", PasswordExtra: "secret"}
+	assert.NotContains(t, message.String(), "secret")
+	assert.Contains(t, message.String(), "test")
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -17,61 +17,161 @@ import (
 const subscribeTemplate = "admin.storages.%s.%s.events" // storage_type and alias
 const publishTemplate = "admin.storages.%s.%s.states"   // storage_type and alias
 
+// Time to export the remaining spans when the service stops
+const spansFlushTimeout = 10 * time.Second
+
 var config Config
 var nc *nats.Conn
-var metrics Metrics = Metrics{}
+
+// _initConfig loads the config and sets up the logger
+func _initConfig() {
+	err := loadEnvFiles(&config)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+
+	err = envconfig.Process("", &config)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+
+	configuredLogger, err := NewLogger(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+	logger = configuredLogger
+
+	err = config.Load()
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+}
 
 // We have to change name of this function so tests are working without being affected by this.
 func _init() {
-	err := envconfig.Process("", &config)
+	_initConfig()
+
+	var err error
+	tracer, err = NewTracer(config.OTLPEndpoint, config.MetricsIdent)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.WithError(err).Fatal("config error")
 	}
 
-	if config.NATSToken != "" {
-		nc, err = nats.Connect(config.NATSURL, nats.Token(config.NATSToken))
-	} else {
-		nc, err = nats.Connect(config.NATSURL)
+	passwordDecrypter, err = NewPasswordDecrypter(config.EncryptionKeys, config.EncryptionRequired)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+	for _, publicKey := range passwordDecrypter.PublicKeys() {
+		logger.With(Fields{"public_key": publicKey}).Info("password encryption key loaded")
 	}
 
-	metrics.Service = config.MetricsIdent
+	eventVerifier, err = NewEventVerifier(config.SigningHMACKeys, config.SigningEd25519Keys, config.SigningRequired, config.SigningWindow)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+
+	passwordPolicy, err = NewPasswordPolicy(config.PasswordMinLength, config.PasswordMinClasses, config.PasswordBreachedList)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
+	if config.AdminPublicKey != "" {
+		adminPublicKey, err = parsePublicKey(config.AdminPublicKey)
+		if err != nil {
+			logger.WithError(err).Fatal("config error")
+		}
+	}
+	if config.PasswordGenerate && adminPublicKey == nil {
+		logger.Fatal("config error: PASSWORD_GENERATE needs ADMIN_PUBLIC_KEY for sending the generated passwords")
+	}
+
+	if config.AuditFile != "" || config.AuditPublish {
+		auditLog, err = NewAuditLog(config.AuditFile, config.AuditMaxSize, config.AuditMaxBackups, config.AuditPublish)
+		if err != nil {
+			logger.WithError(err).Fatal("audit log error")
+		}
+	}
+
+	options, err := natsOptions(&config)
+	if err != nil {
+		logger.WithError(err).Fatal("config error")
+	}
 
+	nc, err = nats.Connect(config.NATSURL, options...)
 	if err != nil {
-		log.Fatalln(err)
+		logger.WithError(err).Fatal("NATS connection error")
 	}
 }
 
 // sends metrics to NATS
 func sentMetrics(nc *nats.Conn, subject string) {
-	metrics.Service = config.MetricsIdent
-
 	receiverMetrics := ReceiverMetric{
 		Service: config.MetricsIdent,
 		Lines: []string{
 			"# HELP storage_service_messages Number of received messages in the current session",
 			"# TYPE storage_service_messages counter",
-			fmt.Sprintf("storage_service_messages{service=\"%s\"} %d", config.MetricsIdent, metrics.Messages),
+			fmt.Sprintf("storage_service_messages{service=\"%s\"} %d", config.MetricsIdent, int(counterValue(metricMessages.WithLabelValues(config.MetricsIdent)))),
 		},
 	}
 
 	data, err := json.Marshal(receiverMetrics)
 	if err != nil {
-		log.Println("ERROR: metrics sending:", err)
+		logger.WithError(err).Error("metrics sending failed")
 	}
 
 	err = nc.Publish(subject, data)
 	if err != nil {
-		log.Println("ERROR: metrics sending:", err)
+		logger.WithError(err).Error("metrics sending failed")
 	}
 }
 
+// serves metrics and health checks over HTTP
+func startHTTPServer(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	logger.With(Fields{"listen": listen}).Info("HTTP server listening")
+	go func() {
+		err := http.ListenAndServe(listen, mux)
+		if err != nil {
+			logger.WithError(err).Fatal("HTTP server error")
+		}
+	}()
+}
+
 func main() {
+	// storage_service keygen prints a new key pair for encryption of passwords
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		err := generateEncryptionKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// storage_service harden <alias> revokes CONNECT from PUBLIC on existing databases of the PostgreSQL server
+	if len(os.Args) > 1 && os.Args[1] == "harden" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: storage_service harden <alias>")
+			os.Exit(2)
+		}
+		_initConfig()
+		err := hardenServer(os.Args[2], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	_init()
 
 	defer func() {
 		err := nc.Drain()
 		if err != nil {
-			log.Println("Drain error:", err.Error())
+			logger.WithError(err).Error("drain error")
 		}
 	}()
 
@@ -83,18 +183,36 @@ func main() {
 		}
 	}()
 
+	if config.HTTPListen != "" {
+		startHTTPServer(config.HTTPListen)
+	}
+
+	if config.SecretsRefresh > 0 {
+		go refreshSecrets(config.SecretsRefresh)
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	for _, database := range strings.Split(config.Databases, ";") {
-		databaseParts := strings.Split(database, ":")
-		subject := fmt.Sprintf(subscribeTemplate, databaseParts[1], databaseParts[0])
+	for _, databaseLine := range config.Servers() {
+		subscribe(databaseLine)
+	}
 
-		log.Println("Listening for " + subject)
-		_, err := nc.Subscribe(subject, messageHandler)
-		if err != nil {
-			log.Println("Subscribe error:", err)
+	// Reload the config on SIGHUP
+	reloadSigs := make(chan os.Signal, 1)
+	signal.Notify(reloadSigs, syscall.SIGHUP)
+	go func() {
+		for range reloadSigs {
+			logger.Info("SIGHUP received, reloading config")
+			err := reloadConfig()
+			if err != nil {
+				logger.WithError(err).Error("config reload failed")
+			}
 		}
+	}()
+
+	if config.ConfigFile != "" && config.ConfigWatch > 0 {
+		go watchConfigFile(config.ConfigFile, config.ConfigWatch)
 	}
 
 	// runtime.Goexit()
@@ -102,7 +220,23 @@ func main() {
 	<-sigs
 	err := nc.Drain()
 	if err != nil {
-		log.Println(err)
+		logger.WithError(err).Error("drain error")
 	}
+	shutdown()
 	os.Exit(0)
 }
+
+// shutdown waits until events received before the signal are processed and exports their spans
+func shutdown() {
+	// Drain closes the connection when all subscriptions are drained or after its timeout
+	for !nc.IsClosed() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spansFlushTimeout)
+	defer cancel()
+	err := tracer.Shutdown(ctx)
+	if err != nil {
+		logger.WithError(err).Error("exporting spans failed")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Histogram buckets in seconds, SQL queries and whole events share them
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// All metrics of the service
+var (
+	registry = prometheus.NewRegistry()
+	metrics  = promauto.With(registry)
+
+	metricMessages = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_service_messages",
+		Help: "Number of received messages in the current session",
+	}, []string{"service"})
+	metricEvents = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_service_events_total",
+		Help: "Number of processed events",
+	}, []string{"event_type", "alias", "backend", "result"})
+	metricEventDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_service_event_duration_seconds",
+		Help:    "Time spent processing a single event",
+		Buckets: durationBuckets,
+	}, []string{"event_type", "alias", "backend"})
+	metricQueryDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_service_backend_query_duration_seconds",
+		Help:    "Time spent running a single SQL query in the backend",
+		Buckets: durationBuckets,
+	}, []string{"alias", "backend", "statement", "result"})
+	metricEventsInFlight = metrics.NewGauge(prometheus.GaugeOpts{
+		Name: "storage_service_events_in_flight",
+		Help: "Number of events being processed right now",
+	})
+	metricLastSuccess = metrics.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "storage_service_last_success_timestamp_seconds",
+		Help: "Unix time of the last successfully processed event",
+	}, []string{"alias"})
+	_ = metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "storage_service_nats_connected",
+		Help: "1 if the service is connected to NATS, 0 otherwise",
+	}, func() float64 {
+		if nc != nil && nc.IsConnected() {
+			return 1
+		}
+		return 0
+	})
+	metricNATSDisconnects = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "storage_service_nats_disconnects_total",
+		Help: "Number of disconnections from NATS",
+	})
+	_ = metrics.NewCounterFunc(prometheus.CounterOpts{
+		Name: "storage_service_nats_reconnects_total",
+		Help: "Number of reconnections to NATS",
+	}, func() float64 {
+		if nc == nil {
+			return 0
+		}
+		return float64(nc.Stats().Reconnects)
+	})
+)
+
+// metricsHandler serves all metrics of the service in Prometheus format
+var metricsHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+// counterValue returns current value of the counter
+func counterValue(counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		return 0
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// queryObserver returns a hook for backends that records duration of every SQL query
+func queryObserver(alias, dbtype string) func(query string, duration time.Duration, err error) {
+	return func(query string, duration time.Duration, err error) {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+
+		statement := "UNKNOWN"
+		if fields := strings.Fields(query); len(fields) > 0 {
+			statement = strings.ToUpper(fields[0])
+		}
+
+		metricQueryDuration.WithLabelValues(alias, dbtype, statement, result).Observe(duration.Seconds())
+	}
+}
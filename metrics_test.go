@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metricEvents.WithLabelValues("created", "dev\"pgsql", "pgsql", "success").Inc()
+	metricEvents.WithLabelValues("created", "dev\"pgsql", "pgsql", "success").Inc()
+	observe := queryObserver("devpgsql", "pgsql")
+	observe("create database test;", 200*time.Millisecond, nil)
+	observe("DROP DATABASE test;", 100*time.Second, errors.New("failed"))
+
+	recorder := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	assert.Contains(t, body, "# TYPE storage_service_events_total counter")
+	assert.Contains(t, body, `storage_service_events_total{alias="dev\"pgsql",backend="pgsql",event_type="created",result="success"} 2`)
+	assert.Contains(t, body, `storage_service_backend_query_duration_seconds_bucket{alias="devpgsql",backend="pgsql",result="success",statement="CREATE",le="0.1"} 0`)
+	assert.Contains(t, body, `storage_service_backend_query_duration_seconds_bucket{alias="devpgsql",backend="pgsql",result="success",statement="CREATE",le="0.25"} 1`)
+	assert.Contains(t, body, `storage_service_backend_query_duration_seconds_bucket{alias="devpgsql",backend="pgsql",result="error",statement="DROP",le="+Inf"} 1`)
+	assert.Contains(t, body, `storage_service_backend_query_duration_seconds_count{alias="devpgsql",backend="pgsql",result="error",statement="DROP"} 1`)
+	assert.Contains(t, body, "storage_service_nats_connected 0")
+}
+
+func TestCounterValue(t *testing.T) {
+	counter := metricMessages.WithLabelValues("test_counter_value")
+	assert.Equal(t, 0.0, counterValue(counter))
+	counter.Inc()
+	counter.Inc()
+	assert.Equal(t, 2.0, counterValue(counter))
+}
@@ -0,0 +1,221 @@
+//go:build integration
+// +build integration
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/stretchr/testify/assert"
+)
+
+// Servers are started by docker-compose.test.yml, see make test-integration
+var integrationServers = map[string]string{
+	"mysql8":  "MYSQL8_TEST_ADDR",
+	"mariadb": "MARIADB_TEST_ADDR",
+}
+
+func integrationBackend(t *testing.T, env string) *MySQLBackend {
+	addr := os.Getenv(env)
+	if addr == "" {
+		t.Skip(env + " is not set")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	assert.Nil(t, err)
+	portNumber, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+
+	password := os.Getenv("MYSQL_TEST_PASSWORD")
+	if password == "" {
+		password = "root"
+	}
+
+	return &MySQLBackend{
+		Username:       "root",
+		Password:       password,
+		Hostname:       host,
+		Port:           portNumber,
+		ConnectTimeout: 5 * time.Second,
+	}
+}
+
+// canLogin returns nil if the user can connect to the database with the password
+func canLogin(m *MySQLBackend, user, password, database string) error {
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s", user, password, net.JoinHostPort(m.Hostname, strconv.Itoa(m.Port)), database))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+func TestIntegrationLifecycle(t *testing.T) {
+	for name, env := range integrationServers {
+		for _, plugin := range append([]string{""}, AuthPlugins...) {
+			t.Run(name+"/"+plugin, func(t *testing.T) {
+				m := integrationBackend(t, env)
+				m.AuthPlugin = plugin
+				m.Hosts = []string{"%", "10.0.%"}
+				defer ClosePools()
+
+				version, err := func() (ServerVersion, error) {
+					assert.Nil(t, m.connect())
+					defer m.close()
+					return m.version()
+				}()
+				assert.Nil(t, err)
+				if plugin == "caching_sha2_password" && (version.MariaDB || !version.AtLeast(8, 0, 3)) {
+					t.Skip("caching_sha2_password is not supported by " + version.String())
+				}
+
+				name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+				assert.Nil(t, m.CreateUser(name, "first's", name))
+				assert.Nil(t, m.CreateDatabase(name, name, nil, dboptions.Options{Charset: "utf8mb4", Collation: "utf8mb4_czech_ci"}))
+				assert.Nil(t, m.CreateROUser(name+"_ro", "ro", name))
+				assert.Nil(t, canLogin(m, name, "first's", name))
+				assert.Nil(t, canLogin(m, name+"_ro", "ro", name))
+
+				hosts, err := func() ([]string, error) {
+					assert.Nil(t, m.connect())
+					defer m.close()
+					return m.userHosts(name)
+				}()
+				assert.Nil(t, err)
+				assert.ElementsMatch(t, []string{"%", "10.0.%"}, hosts)
+
+				assert.Nil(t, m.ChangeDatabaseOptions(name, dboptions.Options{Collation: "utf8mb4_general_ci"}))
+				assert.NotNil(t, m.ChangeDatabaseOptions(name, dboptions.Options{Charset: "latin1", Collation: "utf8mb4_general_ci"}))
+
+				assert.Nil(t, m.ChangePassword(name, "second"))
+				assert.NotNil(t, canLogin(m, name, "first's", name))
+				assert.Nil(t, canLogin(m, name, "second", name))
+
+				assert.Nil(t, m.ChangePassword(name+"_ro", "ro2"))
+				assert.NotNil(t, canLogin(m, name+"_ro", "ro", name))
+				assert.Nil(t, canLogin(m, name+"_ro", "ro2", name))
+				assert.Nil(t, m.DropROUser(name+"_ro", name))
+				assert.NotNil(t, canLogin(m, name+"_ro", "ro2", name))
+
+				// Deleted storage drops the database first and then both users
+				assert.Nil(t, m.CreateROUser(name+"_ro", "ro", name))
+				assert.Nil(t, m.DropDatabase(name))
+				assert.Nil(t, m.DropUser(name+"_ro"))
+				assert.Nil(t, m.DropUser(name))
+			})
+		}
+	}
+}
+
+func TestIntegrationExtraUsers(t *testing.T) {
+	for name, env := range integrationServers {
+		t.Run(name, func(t *testing.T) {
+			m := integrationBackend(t, env)
+			defer ClosePools()
+
+			name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+			assert.Nil(t, m.CreateUser(name, "owner", name))
+			assert.Nil(t, m.CreateDatabase(name, name, nil, dboptions.Options{}))
+
+			for _, role := range roles.All {
+				assert.Nil(t, m.CreateExtraUser(name+"_"+string(role), "secret", name, role), role)
+				assert.Nil(t, canLogin(m, name+"_"+string(role), "secret", name), role)
+			}
+			users, err := m.Users(name)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{name, name + "_migrations", name + "_owner", name + "_readonly", name + "_readwrite"}, users)
+
+			for _, role := range roles.All {
+				assert.Nil(t, m.DropExtraUser(name+"_"+string(role), name), role)
+			}
+			users, err = m.Users(name)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{name}, users)
+
+			assert.Nil(t, m.DropDatabase(name))
+			assert.Nil(t, m.DropUser(name))
+		})
+	}
+}
+
+func TestIntegrationTerminateSessions(t *testing.T) {
+	for name, env := range integrationServers {
+		t.Run(name, func(t *testing.T) {
+			m := integrationBackend(t, env)
+			defer ClosePools()
+
+			name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+			assert.Nil(t, m.CreateUser(name, "owner", name))
+			assert.Nil(t, m.CreateDatabase(name, name, nil, dboptions.Options{}))
+
+			db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s", name, "owner", net.JoinHostPort(m.Hostname, strconv.Itoa(m.Port)), name))
+			assert.Nil(t, err)
+			defer db.Close()
+			conn, err := db.Conn(context.Background())
+			assert.Nil(t, err)
+			assert.Nil(t, conn.PingContext(context.Background()))
+
+			assert.Nil(t, m.TerminateSessions("", name))
+			assert.NotNil(t, conn.PingContext(context.Background()))
+			conn.Close()
+
+			assert.Nil(t, m.DropDatabase(name))
+			assert.Nil(t, m.DropUser(name))
+		})
+	}
+}
+
+func TestIntegrationDeletedWithExtraUsers(t *testing.T) {
+	for name, env := range integrationServers {
+		t.Run(name, func(t *testing.T) {
+			m := integrationBackend(t, env)
+			defer ClosePools()
+
+			name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+			assert.Nil(t, m.CreateUser(name, "owner", name))
+			assert.Nil(t, m.CreateDatabase(name, name, nil, dboptions.Options{}))
+			assert.Nil(t, m.CreateExtraUser(name+"_app", "secret", name, roles.ReadWrite))
+			// Monitoring user with grants on another database isn't named in the event
+			assert.Nil(t, m.CreateDatabase(name+"_other", name, nil, dboptions.Options{}))
+			assert.Nil(t, m.CreateExtraUser(name+"_monitor", "secret", name+"_other", roles.ReadOnly))
+			assert.Nil(t, func() error {
+				assert.Nil(t, m.connect())
+				defer m.close()
+				grant, err := m.grantRoleSQL(name+"_monitor", "%", name, roles.ReadOnly)
+				if err != nil {
+					return err
+				}
+				return m.execute(grant)
+			}())
+
+			// Deletion flow of the service: additional users named by the admin first, then the database and the owner
+			assert.Nil(t, m.DropExtraUser(name+"_app", name))
+			assert.Nil(t, m.DropDatabase(name))
+			assert.Nil(t, m.DropUser(name))
+
+			// The monitoring user keeps its access to the other database
+			assert.Nil(t, canLogin(m, name+"_monitor", "secret", name+"_other"))
+			assert.Nil(t, m.DropExtraUser(name+"_monitor", name+"_other"))
+			assert.Nil(t, m.DropDatabase(name+"_other"))
+
+			// Nothing is left that would give access to a new database with the same name
+			users, err := m.Users(name)
+			assert.Nil(t, err)
+			assert.Empty(t, users)
+			assert.Nil(t, m.CreateUser(name, "owner", name))
+			assert.Nil(t, m.CreateDatabase(name, name, nil, dboptions.Options{}))
+			assert.NotNil(t, canLogin(m, name+"_app", "secret", name))
+			assert.Nil(t, m.DropDatabase(name))
+			assert.Nil(t, m.DropUser(name))
+		})
+	}
+}
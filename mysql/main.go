@@ -1,15 +1,99 @@
 package mysql
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
-	"fmt"
-	"regexp"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/rosti-cz/storage_service/sqlquote"
 )
 
+// Connection pools shared by all backends, key is DSN
+var pools = map[string]*sql.DB{}
+var poolsLock sync.Mutex
+
+// Detected versions of the servers, key is DSN, protected by poolsLock
+var versions = map[string]ServerVersion{}
+
+// Supported authentication plugins of new users
+var AuthPlugins = []string{"caching_sha2_password", "mysql_native_password"}
+
+// ServerVersion is flavour and version of the database server
+type ServerVersion struct {
+	MariaDB bool
+	Major   int
+	Minor   int
+	Patch   int
+}
+
+// parseVersion parses result of SELECT VERSION() like 8.0.32 or 10.6.12-MariaDB-log
+func parseVersion(version string) (ServerVersion, error) {
+	serverVersion := ServerVersion{MariaDB: strings.Contains(strings.ToLower(version), "mariadb")}
+
+	// MariaDB may add 5.5.5- prefix for compatibility of the replication protocol
+	if serverVersion.MariaDB {
+		version = strings.TrimPrefix(version, "5.5.5-")
+	}
+
+	numbers := strings.Split(strings.SplitN(version, "-", 2)[0], ".")
+	if len(numbers) < 2 {
+		return serverVersion, errors.New("unknown server version " + version)
+	}
+
+	parts := []*int{&serverVersion.Major, &serverVersion.Minor, &serverVersion.Patch}
+	for i := 0; i < len(parts) && i < len(numbers); i++ {
+		n, err := strconv.Atoi(numbers[i])
+		if err != nil {
+			return serverVersion, errors.New("unknown server version " + version)
+		}
+		*parts[i] = n
+	}
+
+	return serverVersion, nil
+}
+
+// AtLeast returns true if the version is the same or newer than given one
+func (v ServerVersion) AtLeast(major, minor, patch int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	if v.Minor != minor {
+		return v.Minor > minor
+	}
+	return v.Patch >= patch
+}
+
+// String returns version in format used in logs
+func (v ServerVersion) String() string {
+	flavour := "MySQL"
+	if v.MariaDB {
+		flavour = "MariaDB"
+	}
+	return flavour + " " + strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor) + "." + strconv.Itoa(v.Patch)
+}
+
+// supportsAlterUser returns true if password can be changed by ALTER USER
+func (v ServerVersion) supportsAlterUser() bool {
+	if v.MariaDB {
+		return v.AtLeast(10, 2, 0)
+	}
+	return v.AtLeast(5, 7, 6)
+}
+
 // MySQLBackend is a basic backend handling mysql related stuff.
 type MySQLBackend struct {
 	Username string
@@ -17,26 +101,224 @@ type MySQLBackend struct {
 	Hostname string
 	Port     int
 
+	MaxOpenConns    int           // maximum number of open connections to the server, 0 means unlimited
+	MaxIdleConns    int           // maximum number of idle connections in the pool, 0 means default
+	ConnMaxLifetime time.Duration // how long a connection can be reused, 0 means forever
+	ConnectTimeout  time.Duration // 0 means no timeout
+	QueryTimeout    time.Duration // 0 means no timeout
+
+	TLSMode       string // disable (default), require, verify-ca or verify-full
+	TLSCA         string // path to CA bundle, system CAs are used when empty
+	TLSCert       string // path to client certificate
+	TLSKey        string // path to client key
+	TLSServerName string // name verified in the server's certificate, Hostname is used when empty
+
+	AuthPlugin string // authentication plugin of new users, one of AuthPlugins, server's default is used when empty
+
+	// Hosts new users can connect from, like 10.0.% or 192.168.1.10, % (anywhere) is used when empty.
+	// Existing users are changed and dropped with all their host entries.
+	Hosts []string
+
+	// QueryHook is called after every executed SQL query if set
+	QueryHook func(query string, duration time.Duration, err error)
+
 	db *sql.DB
 }
 
-// Connects to the database
-func (m *MySQLBackend) connect() error {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/", m.Username, m.Password, m.Hostname, m.Port))
+// tlsConfig returns TLS configuration based on TLS* fields, nil means TLS is disabled
+func (m *MySQLBackend) tlsConfig() (*tls.Config, error) {
+	if m.TLSMode == "" || m.TLSMode == "disable" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: m.TLSServerName,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = m.Hostname
+	}
+
+	if m.TLSCA != "" {
+		pem, err := ioutil.ReadFile(m.TLSCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading TLS CA")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in TLS CA " + m.TLSCA)
+		}
+	}
+
+	if m.TLSCert != "" {
+		certificate, err := tls.LoadX509KeyPair(m.TLSCert, m.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading TLS client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	switch m.TLSMode {
+	case "require":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		// the chain is verified but the name isn't
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, tlsConfig.RootCAs)
+		}
+	case "verify-full":
+	default:
+		return nil, errors.New("unknown TLS mode " + m.TLSMode)
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyChain verifies the server's certificate chain against roots without checking its name
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return errors.Wrap(err, "parsing server certificate")
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// tlsConfigName returns name of the TLS configuration registered in the mysql driver,
+// it's derived from the TLS fields so a changed configuration gets a new pool.
+func (m *MySQLBackend) tlsConfigName() string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{m.Hostname, m.TLSMode, m.TLSCA, m.TLSCert, m.TLSKey, m.TLSServerName}, "\x00")))
+	return "storage_service_" + hex.EncodeToString(hash[:8])
+}
+
+// dsn returns data source name for the mysql driver
+func (m *MySQLBackend) dsn() (string, error) {
+	cfg := mysqldriver.NewConfig()
+	cfg.User = m.Username
+	cfg.Passwd = m.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(m.Hostname, strconv.Itoa(m.Port))
+	cfg.Timeout = m.ConnectTimeout
+	// Literals from sqlquote use backslash escapes, they would be read wrong with NO_BACKSLASH_ESCAPES set on the server
+	cfg.Params = map[string]string{"sql_mode": "'NO_ENGINE_SUBSTITUTION'"}
+
+	tlsConfig, err := m.tlsConfig()
+	if err != nil {
+		return "", err
+	}
+	if tlsConfig != nil {
+		cfg.TLSConfig = m.tlsConfigName()
+		err = mysqldriver.RegisterTLSConfig(cfg.TLSConfig, tlsConfig)
+		if err != nil {
+			return "", errors.Wrap(err, "registering TLS config")
+		}
+	}
 
-	// if there is an error opening the connection, handle it
+	return cfg.FormatDSN(), nil
+}
+
+// Connects to the database, the connection pool is shared by all backends with the same DSN
+func (m *MySQLBackend) connect() error {
+	dsn, err := m.dsn()
 	if err != nil {
 		return err
 	}
 
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	db, ok := pools[dsn]
+	if !ok {
+		db, err = sql.Open("mysql", dsn)
+
+		// if there is an error opening the connection, handle it
+		if err != nil {
+			return err
+		}
+
+		pools[dsn] = db
+	}
+
+	db.SetMaxOpenConns(m.MaxOpenConns)
+	if m.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(m.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(m.ConnMaxLifetime)
+
 	m.db = db
 
 	return nil
 }
 
+// version returns flavour and version of the server, it's detected once per connection pool
+func (m *MySQLBackend) version() (ServerVersion, error) {
+	dsn, err := m.dsn()
+	if err != nil {
+		return ServerVersion{}, err
+	}
+
+	poolsLock.Lock()
+	version, ok := versions[dsn]
+	poolsLock.Unlock()
+	if ok {
+		return version, nil
+	}
+
+	ctx := context.Background()
+	if m.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.QueryTimeout)
+		defer cancel()
+	}
+
+	var rawVersion string
+	err = m.db.QueryRowContext(ctx, "SELECT VERSION();").Scan(&rawVersion)
+	if err != nil {
+		return ServerVersion{}, errors.Wrap(err, "detecting server version")
+	}
+	version, err = parseVersion(rawVersion)
+	if err != nil {
+		return ServerVersion{}, err
+	}
+
+	poolsLock.Lock()
+	versions[dsn] = version
+	poolsLock.Unlock()
+
+	return version, nil
+}
+
 // execute runs a single SQL query and doesn't care about its result unless it's an error.
 func (m *MySQLBackend) execute(query string, args ...interface{}) error {
-	_, err := m.db.Query(query, args...)
+	ctx := context.Background()
+	if m.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.QueryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	_, err := m.db.ExecContext(ctx, query, args...)
+	if m.QueryHook != nil {
+		m.QueryHook(query, time.Since(start), err)
+	}
 	if err != nil {
 		return errors.Wrap(err, "SQL query: "+query)
 	}
@@ -44,37 +326,189 @@ func (m *MySQLBackend) execute(query string, args ...interface{}) error {
 	return nil
 }
 
-// Close closes connection to the database
+// queryStrings runs SQL query returning a single string column and returns values of all rows
+func (m *MySQLBackend) queryStrings(query string, args ...interface{}) ([]string, error) {
+	ctx := context.Background()
+	if m.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.QueryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	values, err := func() ([]string, error) {
+		rows, err := m.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		values := []string{}
+		for rows.Next() {
+			var value string
+			err = rows.Scan(&value)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, rows.Err()
+	}()
+	if m.QueryHook != nil {
+		m.QueryHook(query, time.Since(start), err)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "SQL query: "+query)
+	}
+
+	return values, nil
+}
+
+// close releases the connection, the pool itself stays open for next calls
 func (m *MySQLBackend) close() error {
-	return m.db.Close()
+	m.db = nil
+	return nil
 }
 
-// testValue tests string input for unwanted characters
-func (m *MySQLBackend) testValue(value string) error {
-	matched, err := regexp.MatchString(`^[a-zA-Z0-9_\.]*$`, value)
+// ClosePools closes all connection pools
+func ClosePools() error {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	var lastErr error
+	for dsn, db := range pools {
+		err := db.Close()
+		if err != nil {
+			lastErr = err
+		}
+		delete(pools, dsn)
+		delete(versions, dsn)
+	}
+
+	return lastErr
+}
+
+// ClosePool closes the shared connection pool of this server, it's used when the server's credentials change
+func (m *MySQLBackend) ClosePool() error {
+	dsn, err := m.dsn()
 	if err != nil {
-		return errors.Wrap(err, "regexp error")
+		return err
 	}
-	if matched {
+
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	delete(versions, dsn)
+	db, ok := pools[dsn]
+	if !ok {
 		return nil
 	}
+	delete(pools, dsn)
+	return db.Close()
+}
+
+// testValue tests the name can be used as an identifier
+func (m *MySQLBackend) testValue(value string) error {
+	return sqlquote.MySQL.ValidateIdentifier(value)
+}
+
+// account returns quoted account of the user connecting from the host
+func (m *MySQLBackend) account(user, host string) string {
+	return sqlquote.MySQLAccount(user, host)
+}
+
+// hosts returns hosts new users can connect from
+func (m *MySQLBackend) hosts() []string {
+	if len(m.Hosts) == 0 {
+		return []string{"%"}
+	}
+	return m.Hosts
+}
+
+// testHosts tests all hosts can be used in accounts
+func (m *MySQLBackend) testHosts() error {
+	for _, host := range m.hosts() {
+		if err := ValidateHost(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateHost checks the host pattern can be used in an account
+func ValidateHost(host string) error {
+	if host == "" {
+		return errors.New("empty host")
+	}
+	if strings.ContainsRune(host, 0) {
+		return errors.New("host contains NUL character")
+	}
+	if len(host) > 255 {
+		return errors.New("host is longer than 255 bytes")
+	}
+	return nil
+}
+
+// userHosts returns hosts of all existing accounts of the user
+func (m *MySQLBackend) userHosts(user string) ([]string, error) {
+	hosts, err := m.queryStrings("SELECT Host FROM mysql.user WHERE User = ?;", user)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("user " + user + " doesn't exist")
+	}
+	return hosts, nil
+}
+
+// identifiedBy returns authentication part of CREATE USER and ALTER USER statements for the server
+func (m *MySQLBackend) identifiedBy(version ServerVersion, password string) (string, error) {
+	literal := sqlquote.MySQL.Literal(password)
+
+	switch m.AuthPlugin {
+	case "":
+		return "IDENTIFIED BY " + literal, nil
+	case "mysql_native_password":
+		// It's default and the only password based plugin of MariaDB and old MySQL,
+		// MySQL before 5.7.6 doesn't accept IDENTIFIED WITH ... BY
+		if version.MariaDB || !version.supportsAlterUser() {
+			return "IDENTIFIED BY " + literal, nil
+		}
+		return "IDENTIFIED WITH mysql_native_password BY " + literal, nil
+	case "caching_sha2_password":
+		if version.MariaDB || !version.AtLeast(8, 0, 3) {
+			return "", errors.New("caching_sha2_password is not supported by " + version.String())
+		}
+		return "IDENTIFIED WITH caching_sha2_password BY " + literal, nil
+	}
 
-	return errors.New("invalid value")
+	return "", errors.New("unknown authentication plugin " + m.AuthPlugin)
 }
 
-// This is basic escape function used only for passwords
-func (m *MySQLBackend) escape(value string) string {
-	value = strings.Replace(value, "'", `\'`, -1)
-	value = strings.Replace(value, "\"", `\"`, -1)
-	return value
+// createUserSQL returns statement creating the user with the password
+func (m *MySQLBackend) createUserSQL(user, host, password string) (string, error) {
+	version, err := m.version()
+	if err != nil {
+		return "", err
+	}
+
+	identifiedBy, err := m.identifiedBy(version, password)
+	if err != nil {
+		return "", err
+	}
+
+	return "CREATE USER " + m.account(user, host) + " " + identifiedBy + ";", nil
 }
 
 func (m *MySQLBackend) CreateROUser(user, password, database string) error {
-	if m.testValue(user) != nil {
-		return errors.New("invalid format of username")
+	if err := m.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
 	}
-	if m.testValue(database) != nil {
-		return errors.New("invalid format of database")
+	if err := m.testHosts(); err != nil {
+		return errors.Wrap(err, "invalid format of host")
 	}
 
 	if err := m.connect(); err != nil {
@@ -82,27 +516,114 @@ func (m *MySQLBackend) CreateROUser(user, password, database string) error {
 	}
 	defer m.close()
 
-	sqls := []string{
-		"CREATE USER '" + user + "'@'%' IDENTIFIED BY '" + m.escape(password) + "';",
-		"GRANT SELECT PRIVILEGES ON " + database + ".* TO '" + user + "'@'%';",
+	for _, host := range m.hosts() {
+		createUser, err := m.createUserSQL(user, host, password)
+		if err != nil {
+			return err
+		}
+
+		sqls := []string{
+			createUser,
+			"GRANT SELECT ON " + sqlquote.MySQLGrantDatabase(database) + ".* TO " + m.account(user, host) + ";",
+		}
+
+		for _, sql := range sqls {
+			err := m.execute(sql)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Privileges of role presets on the database
+var rolePrivileges = map[roles.Role]string{
+	roles.Owner:      "ALL PRIVILEGES",
+	roles.ReadWrite:  "SELECT, INSERT, UPDATE, DELETE, EXECUTE, CREATE TEMPORARY TABLES, LOCK TABLES",
+	roles.ReadOnly:   "SELECT, SHOW VIEW",
+	roles.Migrations: "SELECT, INSERT, UPDATE, DELETE, CREATE, ALTER, DROP, INDEX, REFERENCES, CREATE VIEW, SHOW VIEW, TRIGGER, CREATE ROUTINE, ALTER ROUTINE, EXECUTE",
+}
+
+// grantRoleSQL returns GRANT statement giving privileges of the role on the database to the account
+func (m *MySQLBackend) grantRoleSQL(user, host, database string, role roles.Role) (string, error) {
+	if err := role.Validate(); err != nil {
+		return "", err
 	}
+	return "GRANT " + rolePrivileges[role] + " ON " + sqlquote.MySQLGrantDatabase(database) + ".* TO " + m.account(user, host) + ";", nil
+}
 
-	for _, sql := range sqls {
-		err := m.execute(sql)
+// CreateExtraUser creates additional user of the database with privileges of the role
+func (m *MySQLBackend) CreateExtraUser(user, password, database string, role roles.Role) error {
+	if err := m.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	if err := m.testHosts(); err != nil {
+		return errors.Wrap(err, "invalid format of host")
+	}
+	if err := role.Validate(); err != nil {
+		return err
+	}
+
+	if err := m.connect(); err != nil {
+		return err
+	}
+	defer m.close()
+
+	for _, host := range m.hosts() {
+		createUser, err := m.createUserSQL(user, host, password)
+		if err != nil {
+			return err
+		}
+		grant, err := m.grantRoleSQL(user, host, database, role)
 		if err != nil {
 			return err
 		}
+
+		for _, sql := range []string{createUser, grant} {
+			err := m.execute(sql)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// DropExtraUser drops additional user of the database, its grants are removed together with the accounts
+func (m *MySQLBackend) DropExtraUser(user, database string) error {
+	return m.DropROUser(user, database)
+}
+
+// Users returns names of users with privileges on the database
+func (m *MySQLBackend) Users(database string) ([]string, error) {
+	if err := m.testValue(database); err != nil {
+		return nil, errors.Wrap(err, "invalid format of database")
+	}
+
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	defer m.close()
+
+	return m.queryStrings("SELECT DISTINCT User FROM mysql.db WHERE Db = ? ORDER BY User;", sqlquote.MySQLDatabasePattern(database))
+}
+
 func (m *MySQLBackend) CreateUser(user, password, database string) error {
-	if m.testValue(user) != nil {
-		return errors.New("invalid format of username")
+	if err := m.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
 	}
-	if m.testValue(database) != nil {
-		return errors.New("invalid format of database")
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+
+	if err := m.testHosts(); err != nil {
+		return errors.Wrap(err, "invalid format of host")
 	}
 
 	if err := m.connect(); err != nil {
@@ -110,16 +631,29 @@ func (m *MySQLBackend) CreateUser(user, password, database string) error {
 	}
 	defer m.close()
 
-	sql := "CREATE USER '" + user + "'@'%' IDENTIFIED BY '" + m.escape(password) + "';"
-	return m.execute(sql)
+	for _, host := range m.hosts() {
+		sql, err := m.createUserSQL(user, host, password)
+		if err != nil {
+			return err
+		}
+		err = m.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (m *MySQLBackend) CreateDatabase(database, owner string, extensions []string) error {
-	if m.testValue(owner) != nil {
-		return errors.New("invalid format of owner")
+func (m *MySQLBackend) CreateDatabase(database, owner string, extensions []string, options dboptions.Options) error {
+	if err := m.testValue(owner); err != nil {
+		return errors.Wrap(err, "invalid format of owner")
 	}
-	if m.testValue(database) != nil {
-		return errors.New("invalid format of database")
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	if err := m.testOptions(options); err != nil {
+		return err
 	}
 
 	if err := m.connect(); err != nil {
@@ -127,26 +661,43 @@ func (m *MySQLBackend) CreateDatabase(database, owner string, extensions []strin
 	}
 	defer m.close()
 
-	sql := "CREATE DATABASE " + database + ";"
+	if err := m.checkOptions(options); err != nil {
+		return err
+	}
+
+	sql := "CREATE DATABASE " + sqlquote.MySQL.Identifier(database) + optionsSQL(options) + ";"
 	err := m.execute(sql)
 	if err != nil {
 		return err
 	}
 
-	sql = "GRANT ALL PRIVILEGES ON " + database + ".* TO '" + owner + "'@'%';"
-	err = m.execute(sql)
+	hosts, err := m.userHosts(owner)
 	if err != nil {
 		return err
 	}
+	for _, host := range hosts {
+		sql = "GRANT ALL PRIVILEGES ON " + sqlquote.MySQLGrantDatabase(database) + ".* TO " + m.account(owner, host) + ";"
+		err = m.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
 
 	sql = "FLUSH PRIVILEGES;"
 
 	return m.execute(sql)
 }
 
-func (m *MySQLBackend) ChangePassword(user, password string) error {
-	if m.testValue(user) != nil {
-		return errors.New("invalid format of user")
+// ChangeDatabaseOptions changes default charset and collation of the database, existing tables are not converted
+func (m *MySQLBackend) ChangeDatabaseOptions(database string, options dboptions.Options) error {
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	if err := m.testOptions(options); err != nil {
+		return err
+	}
+	if options.Charset == "" && options.Collation == "" {
+		return errors.New("charset or collation has to be set")
 	}
 
 	if err := m.connect(); err != nil {
@@ -154,13 +705,118 @@ func (m *MySQLBackend) ChangePassword(user, password string) error {
 	}
 	defer m.close()
 
-	sql := "SET PASSWORD FOR '" + user + "'@'%' = PASSWORD('" + m.escape(password) + "');"
+	if err := m.checkOptions(options); err != nil {
+		return err
+	}
+
+	sql := "ALTER DATABASE " + sqlquote.MySQL.Identifier(database) + optionsSQL(options) + ";"
 	return m.execute(sql)
 }
 
+// testOptions tests format of the database options and that MySQL supports them
+func (m *MySQLBackend) testOptions(options dboptions.Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	if options.Locale != "" || options.Template != "" {
+		return errors.New("locale and template are not supported by MySQL")
+	}
+	return nil
+}
+
+// checkOptions checks the server knows the charset and collation
+func (m *MySQLBackend) checkOptions(options dboptions.Options) error {
+	if options.Charset != "" {
+		charsets, err := m.queryStrings("SELECT CHARACTER_SET_NAME FROM information_schema.CHARACTER_SETS WHERE CHARACTER_SET_NAME = ?;", options.Charset)
+		if err != nil {
+			return err
+		}
+		if len(charsets) == 0 {
+			return errors.New("charset " + options.Charset + " is not supported by the server")
+		}
+	}
+
+	if options.Collation != "" {
+		charsets, err := m.queryStrings("SELECT CHARACTER_SET_NAME FROM information_schema.COLLATIONS WHERE COLLATION_NAME = ?;", options.Collation)
+		if err != nil {
+			return err
+		}
+		if len(charsets) == 0 {
+			return errors.New("collation " + options.Collation + " is not supported by the server")
+		}
+		if options.Charset != "" && !strings.EqualFold(charsets[0], options.Charset) {
+			return errors.New("collation " + options.Collation + " doesn't belong to charset " + options.Charset)
+		}
+	}
+
+	return nil
+}
+
+// optionsSQL returns CHARACTER SET and COLLATE part of CREATE DATABASE and ALTER DATABASE statements
+func optionsSQL(options dboptions.Options) string {
+	sql := ""
+	if options.Charset != "" {
+		sql += " CHARACTER SET " + sqlquote.MySQL.Literal(options.Charset)
+	}
+	if options.Collation != "" {
+		sql += " COLLATE " + sqlquote.MySQL.Literal(options.Collation)
+	}
+	return sql
+}
+
+func (m *MySQLBackend) ChangePassword(user, password string) error {
+	if err := m.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of user")
+	}
+
+	if err := m.connect(); err != nil {
+		return err
+	}
+	defer m.close()
+
+	version, err := m.version()
+	if err != nil {
+		return err
+	}
+
+	hosts, err := m.userHosts(user)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		sql, err := m.changePasswordSQL(version, user, host, password)
+		if err != nil {
+			return err
+		}
+		err = m.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// changePasswordSQL returns statement changing password of the user, ALTER USER is used
+// when the server supports it because PASSWORD() function is removed in MySQL 8.
+func (m *MySQLBackend) changePasswordSQL(version ServerVersion, user, host, password string) (string, error) {
+	if !version.supportsAlterUser() {
+		if m.AuthPlugin == "caching_sha2_password" {
+			return "", errors.New("caching_sha2_password is not supported by " + version.String())
+		}
+		return "SET PASSWORD FOR " + m.account(user, host) + " = PASSWORD(" + sqlquote.MySQL.Literal(password) + ");", nil
+	}
+
+	identifiedBy, err := m.identifiedBy(version, password)
+	if err != nil {
+		return "", err
+	}
+	return "ALTER USER " + m.account(user, host) + " " + identifiedBy + ";", nil
+}
+
 func (m *MySQLBackend) DropUser(user string) error {
-	if m.testValue(user) != nil {
-		return errors.New("invalid format of user")
+	if err := m.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of user")
 	}
 
 	if err := m.connect(); err != nil {
@@ -168,13 +824,151 @@ func (m *MySQLBackend) DropUser(user string) error {
 	}
 	defer m.close()
 
-	sql := "DROP USER '" + user + "';"
-	return m.execute(sql)
+	hosts, err := m.userHosts(user)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		sql := "DROP USER " + m.account(user, host) + ";"
+		err = m.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropROUser drops read-only user, its grants are removed together with the accounts
+func (m *MySQLBackend) DropROUser(user, database string) error {
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	return m.DropUser(user)
+}
+
+// sessionsQuery returns query selecting IDs of connections of the user or to the database, empty values match nothing
+func sessionsQuery(user, database string) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if user != "" {
+		conditions = append(conditions, "USER = ?")
+		args = append(args, user)
+	}
+	if database != "" {
+		conditions = append(conditions, "DB = ?")
+		args = append(args, database)
+	}
+	return "SELECT ID FROM information_schema.PROCESSLIST WHERE (" + strings.Join(conditions, " OR ") + ") AND ID <> CONNECTION_ID();", args
+}
+
+// TerminateSessions kills all connections of the user or to the database
+func (m *MySQLBackend) TerminateSessions(user, database string) error {
+	if user == "" && database == "" {
+		return errors.New("user or database is required")
+	}
+	if user != "" {
+		if err := m.testValue(user); err != nil {
+			return errors.Wrap(err, "invalid format of user")
+		}
+	}
+	if database != "" {
+		if err := m.testValue(database); err != nil {
+			return errors.Wrap(err, "invalid format of database")
+		}
+	}
+
+	if err := m.connect(); err != nil {
+		return err
+	}
+	defer m.close()
+
+	query, args := sessionsQuery(user, database)
+	ids, err := m.queryStrings(query, args...)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return errors.Wrap(err, "invalid connection ID")
+		}
+		err := m.execute("KILL CONNECTION " + id + ";")
+		// The connection could be closed in the meantime
+		if mysqlErr, ok := errors.Cause(err).(*mysqldriver.MySQLError); ok && mysqlErr.Number == 1094 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetLimits sets resource limits of all accounts of the user, zero values remove the limits
+func (m *MySQLBackend) SetLimits(user string, userLimits limits.Limits) error {
+	if err := m.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of user")
+	}
+	if err := userLimits.Validate(); err != nil {
+		return err
+	}
+
+	if err := m.connect(); err != nil {
+		return err
+	}
+	defer m.close()
+
+	version, err := m.version()
+	if err != nil {
+		return err
+	}
+
+	hosts, err := m.userHosts(user)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		sql, err := m.limitsSQL(version, user, host, userLimits)
+		if err != nil {
+			return err
+		}
+		err = m.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// limitsSQL returns statement setting resource limits of the account
+func (m *MySQLBackend) limitsSQL(version ServerVersion, user, host string, userLimits limits.Limits) (string, error) {
+	if userLimits.WorkMem != "" {
+		return "", errors.New("work_mem limit is not supported by " + version.String())
+	}
+
+	options := "MAX_USER_CONNECTIONS " + strconv.Itoa(userLimits.MaxConnections) +
+		" MAX_QUERIES_PER_HOUR " + strconv.Itoa(userLimits.MaxQueriesPerHour) +
+		" MAX_UPDATES_PER_HOUR " + strconv.Itoa(userLimits.MaxUpdatesPerHour)
+
+	if version.MariaDB && version.AtLeast(10, 1, 1) {
+		// MAX_STATEMENT_TIME is in seconds, 0 means no limit
+		options += " MAX_STATEMENT_TIME " + strconv.FormatFloat(float64(userLimits.StatementTimeout)/1000, 'f', -1, 64)
+	} else if userLimits.StatementTimeout != 0 {
+		return "", errors.New("statement_timeout limit is not supported by " + version.String())
+	}
+
+	if !version.supportsAlterUser() {
+		return "GRANT USAGE ON *.* TO " + m.account(user, host) + " WITH " + options + ";", nil
+	}
+	return "ALTER USER " + m.account(user, host) + " WITH " + options + ";", nil
 }
 
 func (m *MySQLBackend) DropDatabase(database string) error {
-	if m.testValue(database) != nil {
-		return errors.New("invalid format of database")
+	if err := m.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
 	}
 
 	if err := m.connect(); err != nil {
@@ -182,6 +976,26 @@ func (m *MySQLBackend) DropDatabase(database string) error {
 	}
 	defer m.close()
 
-	sql := "DROP DATABASE " + database + ";"
+	sql := "DROP DATABASE " + sqlquote.MySQL.Identifier(database) + ";"
 	return m.execute(sql)
 }
+
+// ChangeExtensions is not supported, MySQL doesn't have extensions
+func (m *MySQLBackend) ChangeExtensions(database string, install, remove []string) error {
+	return errors.New("extensions are not supported by MySQL")
+}
+
+// Extensions returns nothing, MySQL doesn't have extensions
+func (m *MySQLBackend) Extensions(database string) (map[string]string, error) {
+	return nil, nil
+}
+
+// Ping checks the database server is available
+func (m *MySQLBackend) Ping(ctx context.Context) error {
+	if err := m.connect(); err != nil {
+		return err
+	}
+	defer m.close()
+
+	return m.db.PingContext(ctx)
+}
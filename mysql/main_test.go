@@ -0,0 +1,180 @@
+package mysql
+
+import (
+	"testing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDSN(t *testing.T) {
+	m := &MySQLBackend{
+		Username: "rosti",
+		Password: "p@ss:w/rd",
+		Hostname: "::1",
+		Port:     3306,
+	}
+
+	dsn, err := m.dsn()
+	assert.Nil(t, err)
+
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ss:w/rd", cfg.Passwd)
+	assert.Equal(t, "[::1]:3306", cfg.Addr)
+	assert.Equal(t, "", cfg.TLSConfig)
+	assert.Equal(t, "'NO_ENGINE_SUBSTITUTION'", cfg.Params["sql_mode"])
+
+	m.TLSMode = "verify-full"
+	m.TLSServerName = "db.example.com"
+	dsn, err = m.dsn()
+	assert.Nil(t, err)
+
+	cfg, err = mysqldriver.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.Equal(t, m.tlsConfigName(), cfg.TLSConfig)
+
+	tlsConfig, err := m.tlsConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "db.example.com", tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+
+	m.TLSMode = "verify-ca"
+	m.TLSCA = "/nonexistent/ca.pem"
+	_, err = m.dsn()
+	assert.NotNil(t, err)
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := map[string]ServerVersion{
+		"8.0.32":                           {Major: 8, Minor: 0, Patch: 32},
+		"8.0.32-0ubuntu0.22.04.2":          {Major: 8, Minor: 0, Patch: 32},
+		"5.7.5-m15-log":                    {Major: 5, Minor: 7, Patch: 5},
+		"10.6.12-MariaDB-1:10.6.12+maria~": {MariaDB: true, Major: 10, Minor: 6, Patch: 12},
+		"5.5.5-10.3.38-MariaDB":            {MariaDB: true, Major: 10, Minor: 3, Patch: 38},
+	}
+	for raw, expected := range tests {
+		version, err := parseVersion(raw)
+		assert.Nil(t, err, raw)
+		assert.Equal(t, expected, version, raw)
+	}
+
+	_, err := parseVersion("unknown")
+	assert.NotNil(t, err)
+}
+
+func TestPasswordSQL(t *testing.T) {
+	mysql8 := ServerVersion{Major: 8, Minor: 0, Patch: 32}
+	mysql56 := ServerVersion{Major: 5, Minor: 6, Patch: 51}
+	mariadb := ServerVersion{MariaDB: true, Major: 10, Minor: 6, Patch: 12}
+	mariadb101 := ServerVersion{MariaDB: true, Major: 10, Minor: 1, Patch: 48}
+
+	m := &MySQLBackend{}
+	sql, err := m.changePasswordSQL(mysql8, "test", "%", "it's")
+	assert.Nil(t, err)
+	assert.Equal(t, `ALTER USER 'test'@'%' IDENTIFIED BY 'it''s';`, sql)
+
+	sql, err = m.changePasswordSQL(mariadb101, "test", "%", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, `SET PASSWORD FOR 'test'@'%' = PASSWORD('secret');`, sql)
+
+	m.AuthPlugin = "caching_sha2_password"
+	sql, err = m.changePasswordSQL(mysql8, "test", "%", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, `ALTER USER 'test'@'%' IDENTIFIED WITH caching_sha2_password BY 'secret';`, sql)
+	_, err = m.changePasswordSQL(mariadb, "test", "%", "secret")
+	assert.NotNil(t, err)
+	_, err = m.changePasswordSQL(mysql56, "test", "%", "secret")
+	assert.NotNil(t, err)
+
+	m.AuthPlugin = "mysql_native_password"
+	sql, err = m.changePasswordSQL(mysql8, "test", "%", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, `ALTER USER 'test'@'%' IDENTIFIED WITH mysql_native_password BY 'secret';`, sql)
+	sql, err = m.changePasswordSQL(mariadb, "test", "10.0.%", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, `ALTER USER 'test'@'10.0.%' IDENTIFIED BY 'secret';`, sql)
+
+	identifiedBy, err := m.identifiedBy(ServerVersion{Major: 5, Minor: 6}, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, `IDENTIFIED BY 'secret'`, identifiedBy)
+	sql, err = m.changePasswordSQL(mysql56, "test", "%", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, `SET PASSWORD FOR 'test'@'%' = PASSWORD('secret');`, sql)
+}
+
+func TestHosts(t *testing.T) {
+	m := &MySQLBackend{}
+	assert.Equal(t, []string{"%"}, m.hosts())
+	assert.Nil(t, m.testHosts())
+
+	m.Hosts = []string{"10.0.%", "192.168.1.10"}
+	assert.Equal(t, []string{"10.0.%", "192.168.1.10"}, m.hosts())
+	assert.Nil(t, m.testHosts())
+	assert.Equal(t, `'test'@'10.0.%'`, m.account("test", "10.0.%"))
+
+	m.Hosts = []string{"10.0.%", ""}
+	assert.NotNil(t, m.testHosts())
+	assert.NotNil(t, ValidateHost("a\x00b"))
+}
+
+func TestLimitsSQL(t *testing.T) {
+	m := &MySQLBackend{}
+	mysql8 := ServerVersion{Major: 8, Minor: 0, Patch: 32}
+	mariadb := ServerVersion{MariaDB: true, Major: 10, Minor: 6, Patch: 12}
+
+	sql, err := m.limitsSQL(mysql8, "test", "%", limits.Limits{MaxConnections: 10, MaxQueriesPerHour: 1000})
+	assert.Nil(t, err)
+	assert.Equal(t, `ALTER USER 'test'@'%' WITH MAX_USER_CONNECTIONS 10 MAX_QUERIES_PER_HOUR 1000 MAX_UPDATES_PER_HOUR 0;`, sql)
+
+	sql, err = m.limitsSQL(mariadb, "test", "%", limits.Limits{MaxConnections: 10, StatementTimeout: 1500})
+	assert.Nil(t, err)
+	assert.Equal(t, `ALTER USER 'test'@'%' WITH MAX_USER_CONNECTIONS 10 MAX_QUERIES_PER_HOUR 0 MAX_UPDATES_PER_HOUR 0 MAX_STATEMENT_TIME 1.5;`, sql)
+
+	sql, err = m.limitsSQL(ServerVersion{Major: 5, Minor: 6}, "test", "%", limits.Limits{MaxConnections: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, `GRANT USAGE ON *.* TO 'test'@'%' WITH MAX_USER_CONNECTIONS 10 MAX_QUERIES_PER_HOUR 0 MAX_UPDATES_PER_HOUR 0;`, sql)
+
+	_, err = m.limitsSQL(mysql8, "test", "%", limits.Limits{StatementTimeout: 1000})
+	assert.NotNil(t, err)
+	_, err = m.limitsSQL(mariadb, "test", "%", limits.Limits{WorkMem: "64MB"})
+	assert.NotNil(t, err)
+}
+
+func TestOptionsSQL(t *testing.T) {
+	assert.Equal(t, "", optionsSQL(dboptions.Options{}))
+	assert.Equal(t, " CHARACTER SET 'utf8mb4' COLLATE 'utf8mb4_czech_ci'", optionsSQL(dboptions.Options{Charset: "utf8mb4", Collation: "utf8mb4_czech_ci"}))
+
+	m := &MySQLBackend{}
+	assert.Nil(t, m.testOptions(dboptions.Options{Charset: "utf8mb4"}))
+	assert.NotNil(t, m.testOptions(dboptions.Options{Locale: "cs_CZ.UTF-8"}))
+	assert.NotNil(t, m.ChangeDatabaseOptions("test", dboptions.Options{}))
+}
+
+func TestSessionsQuery(t *testing.T) {
+	query, args := sessionsQuery("test", "")
+	assert.Equal(t, "SELECT ID FROM information_schema.PROCESSLIST WHERE (USER = ?) AND ID <> CONNECTION_ID();", query)
+	assert.Equal(t, []interface{}{"test"}, args)
+
+	query, args = sessionsQuery("test", "test_db")
+	assert.Equal(t, "SELECT ID FROM information_schema.PROCESSLIST WHERE (USER = ? OR DB = ?) AND ID <> CONNECTION_ID();", query)
+	assert.Equal(t, []interface{}{"test", "test_db"}, args)
+}
+
+func TestGrantRoleSQL(t *testing.T) {
+	m := &MySQLBackend{}
+
+	sql, err := m.grantRoleSQL("app", "%", "my_db", roles.ReadOnly)
+	assert.Nil(t, err)
+	assert.Equal(t, "GRANT SELECT, SHOW VIEW ON `my\\_db`.* TO 'app'@'%';", sql)
+
+	sql, err = m.grantRoleSQL("app", "10.0.%", "test", roles.Owner)
+	assert.Nil(t, err)
+	assert.Equal(t, "GRANT ALL PRIVILEGES ON `test`.* TO 'app'@'10.0.%';", sql)
+
+	_, err = m.grantRoleSQL("app", "%", "test", roles.Role("admin"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// natsOptions returns options for NATS connection based on the config
+func natsOptions(c *Config) ([]nats.Option, error) {
+	options := []nats.Option{
+		nats.Name(c.MetricsIdent),
+		nats.MaxReconnects(c.NATSMaxReconnects),
+		nats.ReconnectWait(c.NATSReconnectWait),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			metricNATSDisconnects.Inc()
+			logger.With(Fields{"server": conn.ConnectedUrl()}).WithError(err).Warn("disconnected from NATS")
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.With(Fields{"server": conn.ConnectedUrl()}).Info("reconnected to NATS")
+		}),
+		nats.ClosedHandler(func(conn *nats.Conn) {
+			logger.WithError(conn.LastError()).Warn("NATS connection closed")
+		}),
+		nats.ErrorHandler(func(conn *nats.Conn, subscription *nats.Subscription, err error) {
+			fields := Fields{}
+			if subscription != nil {
+				fields["subject"] = subscription.Subject
+			}
+			logger.With(fields).WithError(err).Error("NATS error")
+		}),
+	}
+
+	// Authentication, only one method can be used
+	methods := 0
+	if c.NATSAuthToken() != "" {
+		methods++
+		// token is read on every reconnect so rotated tokens are used
+		options = append(options, nats.TokenHandler(c.NATSAuthToken))
+	}
+	if c.NATSUser != "" {
+		methods++
+		options = append(options, nats.UserInfo(c.NATSUser, c.NATSPassword))
+	}
+	if c.NATSNKeySeed != "" {
+		methods++
+		option, err := nats.NkeyOptionFromSeed(c.NATSNKeySeed)
+		if err != nil {
+			return nil, errors.Wrap(err, "NATS NKey seed")
+		}
+		options = append(options, option)
+	}
+	if c.NATSCreds != "" {
+		methods++
+		options = append(options, nats.UserCredentials(c.NATSCreds))
+	}
+	if methods > 1 {
+		return nil, errors.New("only one of NATS token, user, NKey seed or credentials file can be used")
+	}
+
+	// TLS
+	if c.NATSTLSCA != "" {
+		options = append(options, nats.RootCAs(c.NATSTLSCA))
+	}
+	if c.NATSTLSCert != "" || c.NATSTLSKey != "" {
+		if c.NATSTLSCert == "" || c.NATSTLSKey == "" {
+			return nil, errors.New("both NATS_TLS_CERT and NATS_TLS_KEY have to be set")
+		}
+		options = append(options, nats.ClientCert(c.NATSTLSCert, c.NATSTLSKey))
+	}
+
+	return options, nil
+}
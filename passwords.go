@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Characters of generated passwords, symbols are safe in connection URLs and shells
+const passwordAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.~"
+
+// State reported to the admin when a password doesn't pass the policy
+const passwordPolicyState = "password policy violation"
+
+// PasswordPolicy checks passwords coming in the events
+type PasswordPolicy struct {
+	MinLength  int // in characters
+	MinClasses int // number of character classes (lowercase, uppercase, digits, other) the password has to contain
+
+	breached map[string]bool // uppercase hex encoded SHA-1 hashes of breached passwords
+}
+
+// NewPasswordPolicy returns policy, breachedList is path to a file with breached passwords,
+// one per line, either in plaintext or as SHA-1 hashes in format of Have I Been Pwned (HASH:count).
+func NewPasswordPolicy(minLength, minClasses int, breachedList string) (*PasswordPolicy, error) {
+	if minLength < 1 {
+		return nil, errors.New("minimal password length has to be at least 1")
+	}
+	if minClasses < 0 || minClasses > 4 {
+		return nil, errors.New("minimal number of character classes has to be between 0 and 4")
+	}
+
+	policy := &PasswordPolicy{
+		MinLength:  minLength,
+		MinClasses: minClasses,
+		breached:   map[string]bool{},
+	}
+
+	if breachedList != "" {
+		err := policy.loadBreached(breachedList)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// passwordPolicy is replaced in _init() based on the config
+var passwordPolicy = &PasswordPolicy{MinLength: 1}
+
+func (p *PasswordPolicy) loadBreached(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening breached passwords list")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		hash := strings.SplitN(line, ":", 2)[0]
+		if _, err := hex.DecodeString(hash); err == nil && len(hash) == 2*sha1.Size {
+			p.breached[strings.ToUpper(hash)] = true
+			continue
+		}
+		p.breached[passwordHash(line)] = true
+	}
+
+	return errors.Wrap(scanner.Err(), "reading breached passwords list")
+}
+
+// passwordHash returns uppercase hex encoded SHA-1 hash of the password
+func passwordHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// characterClasses returns number of character classes used in the password
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// Check returns error if the password doesn't pass the policy
+func (p *PasswordPolicy) Check(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return errors.Errorf("password has to be at least %d characters long", p.MinLength)
+	}
+	if characterClasses(password) < p.MinClasses {
+		return errors.Errorf("password has to contain at least %d of lowercase letters, uppercase letters, digits and other characters", p.MinClasses)
+	}
+	if p.breached[passwordHash(password)] {
+		return errors.New("password is in the list of breached passwords")
+	}
+
+	return nil
+}
+
+// Generate returns a random password passing the policy
+func (p *PasswordPolicy) Generate(length int) (string, error) {
+	if length < p.MinLength {
+		length = p.MinLength
+	}
+
+	alphabetLength := big.NewInt(int64(len(passwordAlphabet)))
+	for try := 0; try < 100; try++ {
+		password := make([]byte, length)
+		for i := range password {
+			n, err := rand.Int(rand.Reader, alphabetLength)
+			if err != nil {
+				return "", errors.Wrap(err, "generating password")
+			}
+			password[i] = passwordAlphabet[n.Int64()]
+		}
+
+		if p.Check(string(password)) == nil {
+			return string(password), nil
+		}
+	}
+
+	return "", errors.New("generated password doesn't pass the policy, increase its length")
+}
+
+// preparePasswords generates passwords missing in the event if enabled and checks all of them by the policy.
+// Generated passwords are sealed with the admin's public key so they can be sent back in the state.
+func preparePasswords(message *Message) error {
+	var err error
+	if message.EventType == "created" || message.EventType == "password_changed" {
+		message.Password, message.sealedPassword, err = preparePassword(message.Password)
+		if err != nil {
+			return errors.Wrap(err, "password")
+		}
+	}
+
+	// RO user is created with the storage only when its password is set or generated
+	roCreated := message.EventType == "created" && message.UsernameRO != "" && (message.PasswordRO != "" || config.PasswordGenerate)
+	if roCreated || message.EventType == "ro_user_created" || message.EventType == "ro_password_changed" {
+		message.PasswordRO, message.sealedPasswordRO, err = preparePassword(message.PasswordRO)
+		if err != nil {
+			return errors.Wrap(err, "password_ro")
+		}
+	}
+
+	if message.EventType == "user_added" {
+		message.PasswordExtra, message.sealedPasswordExtra, err = preparePassword(message.PasswordExtra)
+		if err != nil {
+			return errors.Wrap(err, "password_extra")
+		}
+	}
+
+	return nil
+}
+
+// preparePassword returns the password and its sealed version if it was generated
+func preparePassword(password string) (string, string, error) {
+	if password == "" && config.PasswordGenerate {
+		generated, err := passwordPolicy.Generate(config.PasswordGenerateLength)
+		if err != nil {
+			return "", "", err
+		}
+		sealed, err := sealPassword(generated, adminPublicKey)
+		if err != nil {
+			return "", "", err
+		}
+		return generated, sealed, nil
+	}
+
+	return password, "", passwordPolicy.Check(password)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	breachedFile, err := ioutil.TempFile("", "breached")
+	assert.Nil(t, err)
+	defer os.Remove(breachedFile.Name())
+	// Plaintext password and SHA-1 of "Password1!" in HIBP format
+	_, err = breachedFile.WriteString("Qwerty123!\r\n" + strings.ToLower(passwordHash("Password1!")) + ":12345\n")
+	assert.Nil(t, err)
+	breachedFile.Close()
+
+	policy, err := NewPasswordPolicy(10, 3, breachedFile.Name())
+	assert.Nil(t, err)
+
+	assert.Nil(t, policy.Check("correct-Horse-battery"))
+	assert.NotNil(t, policy.Check(""))
+	assert.NotNil(t, policy.Check("Short1!"))
+	assert.NotNil(t, policy.Check("onlylowercaseletters"))
+	assert.NotNil(t, policy.Check("Qwerty123!"))
+	assert.NotNil(t, policy.Check("Password1!"))
+
+	for i := 0; i < 10; i++ {
+		password, err := policy.Generate(8)
+		assert.Nil(t, err)
+		assert.Len(t, password, 10)
+		assert.Nil(t, policy.Check(password))
+	}
+
+	_, err = NewPasswordPolicy(0, 0, "")
+	assert.NotNil(t, err)
+	_, err = NewPasswordPolicy(8, 5, "")
+	assert.NotNil(t, err)
+	_, err = NewPasswordPolicy(8, 0, "/nonexistent/breached.txt")
+	assert.NotNil(t, err)
+}
+
+func TestPreparePasswords(t *testing.T) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	oldConfig, oldPolicy, oldKey := config, passwordPolicy, adminPublicKey
+	defer func() {
+		config, passwordPolicy, adminPublicKey = oldConfig, oldPolicy, oldKey
+	}()
+	config.PasswordGenerate = true
+	config.PasswordGenerateLength = 24
+	passwordPolicy, err = NewPasswordPolicy(12, 0, "")
+	assert.Nil(t, err)
+	adminPublicKey = public
+
+	message := Message{EventType: "created", Username: "test", UsernameRO: "test_ro"}
+	assert.Nil(t, preparePasswords(&message))
+	assert.Len(t, message.Password, 24)
+	assert.Len(t, message.PasswordRO, 24)
+
+	// Admin can open the generated password
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(message.sealedPassword, encryptedPrefix))
+	assert.Nil(t, err)
+	opened, ok := box.OpenAnonymous(nil, sealed, public, private)
+	assert.True(t, ok)
+	assert.Equal(t, message.Password, string(opened))
+
+	// Passwords sent by the admin are checked
+	message = Message{EventType: "password_changed", Username: "test", Password: "short"}
+	assert.NotNil(t, preparePasswords(&message))
+	message = Message{EventType: "password_changed", Username: "test", Password: "long enough password"}
+	assert.Nil(t, preparePasswords(&message))
+	assert.Equal(t, "", message.sealedPassword)
+
+	// Only RO password is prepared for RO user events
+	message = Message{EventType: "ro_user_created", Username: "test", UsernameRO: "test_ro"}
+	assert.Nil(t, preparePasswords(&message))
+	assert.Equal(t, "", message.Password)
+	assert.Len(t, message.PasswordRO, 24)
+	assert.NotEqual(t, "", message.sealedPasswordRO)
+	message = Message{EventType: "ro_password_changed", UsernameRO: "test_ro", PasswordRO: "short"}
+	assert.NotNil(t, preparePasswords(&message))
+
+	message = Message{EventType: "user_added", UsernameExtra: "test_app", Role: "readwrite"}
+	assert.Nil(t, preparePasswords(&message))
+	assert.Len(t, message.PasswordExtra, 24)
+	assert.NotEqual(t, "", message.sealedPasswordExtra)
+
+	// Nothing is generated when it's disabled
+	config.PasswordGenerate = false
+	message = Message{EventType: "created", Username: "test", UsernameRO: "test_ro", Password: "long enough password"}
+	assert.Nil(t, preparePasswords(&message))
+	assert.Equal(t, "", message.PasswordRO)
+	message = Message{EventType: "created", Username: "test"}
+	assert.NotNil(t, preparePasswords(&message))
+}
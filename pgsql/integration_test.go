@@ -0,0 +1,336 @@
+//go:build integration
+// +build integration
+
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/stretchr/testify/assert"
+)
+
+// Server is started by docker-compose.test.yml, see make test-integration
+func integrationBackend(t *testing.T) *PGSQLBackend {
+	addr := os.Getenv("PGSQL_TEST_ADDR")
+	if addr == "" {
+		t.Skip("PGSQL_TEST_ADDR is not set")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	assert.Nil(t, err)
+	portNumber, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+
+	password := os.Getenv("PGSQL_TEST_PASSWORD")
+	if password == "" {
+		password = "postgres"
+	}
+
+	return &PGSQLBackend{
+		Username:       "postgres",
+		Password:       password,
+		Hostname:       host,
+		Port:           portNumber,
+		ConnectTimeout: 5 * time.Second,
+	}
+}
+
+// canLogin returns nil if the user can connect to the database with the password
+func canLogin(p *PGSQLBackend, user, password, database string) error {
+	login := &PGSQLBackend{Username: user, Password: password, Hostname: p.Hostname, Port: p.Port}
+	db, err := sql.Open("postgres", login.dsn(database))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+// runAs runs SQL query connected as the user to the database
+func runAs(p *PGSQLBackend, user, password, database, query string) error {
+	login := &PGSQLBackend{Username: user, Password: password, Hostname: p.Hostname, Port: p.Port}
+	db, err := sql.Open("postgres", login.dsn(database))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(query)
+	return err
+}
+
+func TestIntegrationROUser(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "first's", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+
+	// RO user added to existing database, its password changed and removed again
+	assert.Nil(t, p.CreateROUser(name+"_ro", "ro", name))
+	assert.Nil(t, canLogin(p, name+"_ro", "ro", name))
+
+	// Tables created by the owner later are readable, but not writable, by the RO user
+	assert.Nil(t, runAs(p, name, "first's", name, "CREATE TABLE "+ident(name)+".items (id int);"))
+	assert.Nil(t, runAs(p, name+"_ro", "ro", name, "SELECT * FROM "+ident(name)+".items;"))
+	assert.NotNil(t, runAs(p, name+"_ro", "ro", name, "INSERT INTO "+ident(name)+".items VALUES (1);"))
+	assert.Nil(t, p.ChangePassword(name+"_ro", "ro2"))
+	assert.NotNil(t, canLogin(p, name+"_ro", "ro", name))
+	assert.Nil(t, canLogin(p, name+"_ro", "ro2", name))
+	assert.Nil(t, p.DropROUser(name+"_ro", name))
+	assert.NotNil(t, canLogin(p, name+"_ro", "ro2", name))
+
+	// Deleted storage drops the database first and then both users
+	assert.Nil(t, p.CreateROUser(name+"_ro", "ro", name))
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name+"_ro"))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationExtraUsers(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+
+	for _, role := range roles.All {
+		assert.Nil(t, p.CreateExtraUser(name+"_"+string(role), "secret", name, role), role)
+		assert.Nil(t, canLogin(p, name+"_"+string(role), "secret", name), role)
+	}
+	users, err := p.Users(name)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name, name + "_migrations", name + "_owner", name + "_readonly", name + "_readwrite"}, users)
+
+	// Tables created by owner user belong to the owner so other users can use them
+	table := ident(name) + ".created_by_extra"
+	assert.Nil(t, runAs(p, name+"_owner", "secret", name, "CREATE TABLE "+table+" (id int, value text);"))
+	assert.Nil(t, runAs(p, name+"_readwrite", "secret", name, "INSERT INTO "+table+" VALUES (1, 'a');"))
+	assert.Nil(t, runAs(p, name+"_readonly", "secret", name, "SELECT * FROM "+table+";"))
+
+	// Migrations user changes data of all tables and structure of its own ones, it can't act as the owner
+	migrationsTable := ident(name) + ".created_by_migrations"
+	assert.Nil(t, runAs(p, name+"_migrations", "secret", name, "UPDATE "+table+" SET value = 'b';"))
+	assert.Nil(t, runAs(p, name+"_migrations", "secret", name, "CREATE TABLE "+migrationsTable+" (id int);"))
+	assert.Nil(t, runAs(p, name+"_migrations", "secret", name, "ALTER TABLE "+migrationsTable+" ADD COLUMN value text;"))
+	assert.Nil(t, runAs(p, name, "owner", name, "INSERT INTO "+migrationsTable+" VALUES (1, 'a');"))
+	assert.NotNil(t, runAs(p, name+"_migrations", "secret", name, "ALTER ROLE "+ident(name)+" PASSWORD 'changed';"))
+
+	for _, role := range roles.All {
+		assert.Nil(t, p.DropExtraUser(name+"_"+string(role), name), role)
+	}
+	users, err = p.Users(name)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name}, users)
+	assert.Nil(t, runAs(p, name, "owner", name, "SELECT * FROM "+table+";"))
+	assert.Nil(t, runAs(p, name, "owner", name, "ALTER TABLE "+migrationsTable+" ADD COLUMN note text;"))
+
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationHarden(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+	assert.Nil(t, p.CreateUser(name+"_other", "other", name+"_other"))
+	assert.NotNil(t, canLogin(p, name+"_other", "other", name))
+
+	// Database created before the isolation
+	assert.Nil(t, p.connect(p.Username))
+	assert.Nil(t, p.execute("GRANT CONNECT ON DATABASE "+ident(name)+" TO PUBLIC;"))
+	p.close()
+	assert.Nil(t, canLogin(p, name+"_other", "other", name))
+
+	changes, err := p.Harden(func(database string) bool { return database != name })
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"database " + name + ": CONNECT revoked from PUBLIC and granted to " + name}, changes)
+	assert.NotNil(t, canLogin(p, name+"_other", "other", name))
+	assert.Nil(t, canLogin(p, name, "owner", name))
+
+	changes, err = p.Harden(func(database string) bool { return database != name })
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name+"_other"))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationTerminateSessions(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+
+	login := &PGSQLBackend{Username: name, Password: "owner", Hostname: p.Hostname, Port: p.Port}
+	db, err := sql.Open("postgres", login.dsn(name))
+	assert.Nil(t, err)
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, conn.PingContext(context.Background()))
+
+	assert.Nil(t, p.TerminateSessions(name, ""))
+	assert.NotNil(t, conn.PingContext(context.Background()))
+	conn.Close()
+
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationDatabaseOptions(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+
+	// Locale spelled differently than the normalized name in pg_collation (en_US.utf8)
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{Charset: "UTF8", Locale: "en_US.UTF-8"}))
+	assert.NotNil(t, p.CreateDatabase(name+"_x", name, nil, dboptions.Options{Charset: "UTF8", Locale: "xx_XX.UTF-8"}))
+	assert.NotNil(t, p.CreateDatabase(name+"_y", name, nil, dboptions.Options{Charset: "NOPE"}))
+
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationExtensions(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+
+	// Installing twice updates the extension to the latest version
+	assert.Nil(t, p.ChangeExtensions(name, []string{"pg_trgm", "hstore"}, nil))
+	assert.Nil(t, p.ChangeExtensions(name, []string{"pg_trgm"}, nil))
+	extensions, err := p.Extensions(name)
+	assert.Nil(t, err)
+	assert.Contains(t, extensions, "plpgsql")
+	assert.NotEmpty(t, extensions["pg_trgm"])
+	assert.NotEmpty(t, extensions["hstore"])
+
+	assert.Nil(t, p.ChangeExtensions(name, nil, []string{"pg_trgm"}))
+	extensions, err = p.Extensions(name)
+	assert.Nil(t, err)
+	assert.NotContains(t, extensions, "pg_trgm")
+
+	// Column using the type blocks dropping of the extension
+	assert.Nil(t, p.connect(name))
+	assert.Nil(t, p.execute("CREATE TABLE public.blocker (value "+ident(name)+".hstore);"))
+	p.close()
+	assert.NotNil(t, p.ChangeExtensions(name, nil, []string{"hstore"}))
+	extensions, err = p.Extensions(name)
+	assert.Nil(t, err)
+	assert.Contains(t, extensions, "hstore")
+
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationDeletedWithExtraUsers(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+	assert.Nil(t, p.CreateExtraUser(name+"_app", "secret", name, roles.ReadWrite))
+	assert.Nil(t, p.CreateExtraUser(name+"_admin", "secret", name, roles.Owner))
+	// Monitoring user with access to another database isn't named in the event
+	assert.Nil(t, p.CreateDatabase(name+"_other", name, nil, dboptions.Options{}))
+	assert.Nil(t, p.CreateExtraUser(name+"_monitor", "secret", name+"_other", roles.ReadOnly))
+	assert.Nil(t, func() error {
+		assert.Nil(t, p.connect(p.Username))
+		defer p.close()
+		return p.execute("GRANT CONNECT ON DATABASE " + ident(name) + " TO " + ident(name+"_monitor") + ";")
+	}())
+
+	// Deletion flow of the service: additional users named by the admin first, then the database and the owner
+	for _, user := range []string{name + "_app", name + "_admin"} {
+		assert.Nil(t, p.DropExtraUser(user, name))
+	}
+	assert.Nil(t, p.DropDatabase(name))
+
+	// The monitoring user keeps its access to the other database
+	assert.Nil(t, runAs(p, name+"_monitor", "secret", name+"_other", "SELECT 1;"))
+	assert.Nil(t, p.DropExtraUser(name+"_monitor", name+"_other"))
+	assert.Nil(t, p.DropDatabase(name+"_other"))
+	assert.Nil(t, p.DropUser(name))
+
+	// No orphaned logins are left
+	assert.Nil(t, p.connect(p.Username))
+	defer p.close()
+	left, err := p.queryStrings("SELECT rolname FROM pg_roles WHERE rolname LIKE $1;", name+"%")
+	assert.Nil(t, err)
+	assert.Empty(t, left)
+}
+
+func TestIntegrationChangedSchemaStrategy(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	name := "test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, p.CreateUser(name, "owner", name))
+	assert.Nil(t, p.CreateDatabase(name, name, nil, dboptions.Options{}))
+	assert.Nil(t, runAs(p, name, "owner", name, "CREATE TABLE items (id int);"))
+
+	// Database created with per-database schema keeps using it when the strategy of the server changes
+	p.SchemaStrategy = SchemaPublic
+	assert.Nil(t, p.CreateROUser(name+"_ro", "ro", name))
+	assert.Nil(t, runAs(p, name+"_ro", "ro", name, "SELECT * FROM items;"))
+	assert.Nil(t, p.ChangeExtensions(name, []string{"pg_trgm"}, nil))
+
+	schemas, err := func() ([]string, error) {
+		assert.Nil(t, p.connect(name))
+		defer p.close()
+		return p.queryStrings("SELECT n.nspname FROM pg_extension e JOIN pg_namespace n ON n.oid = e.extnamespace WHERE e.extname = 'pg_trgm';")
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name}, schemas)
+
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name+"_ro"))
+	assert.Nil(t, p.DropUser(name))
+}
+
+func TestIntegrationLegacyNames(t *testing.T) {
+	p := integrationBackend(t)
+	defer ClosePools()
+
+	// Older versions didn't quote names so PostgreSQL folded them to lower case
+	name := "Test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	assert.Nil(t, func() error {
+		assert.Nil(t, p.connect(p.Username))
+		defer p.close()
+		for _, sql := range []string{"CREATE USER " + name + " WITH PASSWORD 'owner';", "CREATE DATABASE " + name + " OWNER " + name + ";"} {
+			if err := p.execute(sql); err != nil {
+				return err
+			}
+		}
+		return nil
+	}())
+
+	assert.Nil(t, p.ChangePassword(name, "second"))
+	assert.Nil(t, canLogin(p, strings.ToLower(name), "second", strings.ToLower(name)))
+	assert.Nil(t, p.ChangeExtensions(name, []string{"pg_trgm"}, nil))
+	assert.Nil(t, p.DropDatabase(name))
+	assert.Nil(t, p.DropUser(name))
+}
@@ -1,15 +1,41 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/rosti-cz/storage_service/sqlquote"
 )
 
+// Shortcuts for quoting of identifiers and literals
+var ident = sqlquote.PostgreSQL.Identifier
+var literal = sqlquote.PostgreSQL.Literal
+
+// Connection pools to the admin databases shared by all backends, key is DSN
+var pools = map[string]*sql.DB{}
+var poolsLock sync.Mutex
+
+// Schema strategies, they say where objects of the users live
+const (
+	SchemaPublic   = "public"   // public schema owned by the user
+	SchemaDatabase = "database" // schema named after the database, it's first in search_path of the users
+	SchemaBoth     = "both"     // schema named after the database and public schema owned by the user
+)
+
+// SchemaStrategies contains all supported schema strategies
+var SchemaStrategies = []string{SchemaPublic, SchemaDatabase, SchemaBoth}
+
 // PGSQLBackend is a basic backend handling pgsql related stuff.
 type PGSQLBackend struct {
 	Username string
@@ -17,27 +43,118 @@ type PGSQLBackend struct {
 	Hostname string
 	Port     int
 
-	db *sql.DB
+	MaxOpenConns    int           // maximum number of open connections to the server, 0 means unlimited
+	MaxIdleConns    int           // maximum number of idle connections in the pool, 0 means default
+	ConnMaxLifetime time.Duration // how long a connection can be reused, 0 means forever
+	ConnectTimeout  time.Duration // 0 means no timeout
+	QueryTimeout    time.Duration // 0 means no timeout
+
+	TLSMode string // disable (default), require, verify-ca or verify-full
+	TLSCA   string // path to CA bundle
+	TLSCert string // path to client certificate
+	TLSKey  string // path to client key
+
+	// SchemaStrategy says where objects of the users live, SchemaDatabase when empty
+	SchemaStrategy string
+
+	// QueryHook is called after every executed SQL query if set
+	QueryHook func(query string, duration time.Duration, err error)
+
+	db     *sql.DB
+	pooled bool // true if db is shared pool that can't be closed
+}
+
+// dsnValue quotes a value for the key=value connection string
+func dsnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "'", `\'`, -1)
+	return "'" + value + "'"
+}
+
+// dsn returns connection string for the pq driver
+func (p *PGSQLBackend) dsn(database string) string {
+	sslmode := p.TLSMode
+	if sslmode == "" {
+		sslmode = "disable"
+	}
+
+	dsn := fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(p.Hostname), p.Port, dsnValue(p.Username), dsnValue(p.Password), dsnValue(database), dsnValue(sslmode),
+	)
+	if p.TLSCA != "" {
+		dsn += " sslrootcert=" + dsnValue(p.TLSCA)
+	}
+	if p.TLSCert != "" {
+		dsn += " sslcert=" + dsnValue(p.TLSCert) + " sslkey=" + dsnValue(p.TLSKey)
+	}
+	if p.ConnectTimeout > 0 {
+		// pq accepts only whole seconds
+		dsn += fmt.Sprintf(" connect_timeout=%d", int((p.ConnectTimeout+time.Second-1)/time.Second))
+	}
+	return dsn
 }
 
 // Connects to the database
-// Database with same name as the username has to exist
+// Database with same name as the username has to exist. Connection pool to this database
+// is shared by all backends. Connections to other databases are closed by close() so they
+// don't block dropping of the databases.
 func (p *PGSQLBackend) connect(database string) error {
-	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", p.Hostname, p.Port, p.Username, p.Password, database))
+	dsn := p.dsn(database)
 
-	// if there is an error opening the connection, handle it
-	if err != nil {
-		return err
+	if database != p.Username {
+		db, err := sql.Open("postgres", dsn)
+
+		// if there is an error opening the connection, handle it
+		if err != nil {
+			return err
+		}
+
+		p.db = db
+		p.pooled = false
+		return nil
+	}
+
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	db, ok := pools[dsn]
+	if !ok {
+		var err error
+		db, err = sql.Open("postgres", dsn)
+		if err != nil {
+			return err
+		}
+
+		pools[dsn] = db
+	}
+
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
 	}
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
 
 	p.db = db
+	p.pooled = true
 
 	return nil
 }
 
 // execute runs a single SQL query and doesn't care about its result unless it's an error.
 func (p *PGSQLBackend) execute(query string, args ...interface{}) error {
-	_, err := p.db.Query(query, args...)
+	ctx := context.Background()
+	if p.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.QueryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	_, err := p.db.ExecContext(ctx, query, args...)
+	if p.QueryHook != nil {
+		p.QueryHook(query, time.Since(start), err)
+	}
 	if err != nil {
 		return errors.Wrap(err, "SQL query: "+query)
 	}
@@ -45,37 +162,185 @@ func (p *PGSQLBackend) execute(query string, args ...interface{}) error {
 	return nil
 }
 
-// testValue tests string input for unwanted characters
+// ClosePools closes all connection pools
+func ClosePools() error {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	var lastErr error
+	for dsn, db := range pools {
+		err := db.Close()
+		if err != nil {
+			lastErr = err
+		}
+		delete(pools, dsn)
+	}
+
+	return lastErr
+}
+
+// ClosePool closes the shared connection pool of this server, it's used when the server's credentials change
+func (p *PGSQLBackend) ClosePool() error {
+	dsn := p.dsn(p.Username)
+
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	db, ok := pools[dsn]
+	if !ok {
+		return nil
+	}
+	delete(pools, dsn)
+	return db.Close()
+}
+
+// Names accepted before identifiers were quoted, PostgreSQL folded them to lower case
+var legacyNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\.]+$`)
+
+// foldName returns the name as PostgreSQL stored it when it was created by older versions of the service
+// without quoting, so existing databases and users with upper case letters in the name are found.
+// Other names are used exactly as they are.
+func foldName(name string) string {
+	if legacyNameRegexp.MatchString(name) {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// testValue tests the name can be used as an identifier
 func (p *PGSQLBackend) testValue(value string) error {
-	matched, err := regexp.MatchString(`^[a-zA-Z0-9_\.]*$`, value)
+	return sqlquote.PostgreSQL.ValidateIdentifier(value)
+}
+
+// queryRows runs SQL query and returns all rows with values of all columns as strings
+func (p *PGSQLBackend) queryRows(query string, args ...interface{}) ([][]string, error) {
+	ctx := context.Background()
+	if p.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.QueryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	result, err := func() ([][]string, error) {
+		rows, err := p.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+
+		result := [][]string{}
+		for rows.Next() {
+			values := make([]string, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			err = rows.Scan(pointers...)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, values)
+		}
+		return result, rows.Err()
+	}()
+	if p.QueryHook != nil {
+		p.QueryHook(query, time.Since(start), err)
+	}
 	if err != nil {
-		return errors.Wrap(err, "regexp error")
+		return nil, errors.Wrap(err, "SQL query: "+query)
 	}
-	if matched {
+
+	return result, nil
+}
+
+// queryStrings runs SQL query returning a single string column and returns values of all rows
+func (p *PGSQLBackend) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := p.queryRows(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for _, row := range rows {
+		values = append(values, row[0])
+	}
+	return values, nil
+}
+
+// close closes connection to the database, shared pool stays open for next calls
+func (p *PGSQLBackend) close() error {
+	db := p.db
+	p.db = nil
+	if p.pooled {
 		return nil
 	}
+	return db.Close()
+}
 
-	return errors.New("invalid value")
+// strategySchemas returns schemas the users of new database work in according to the schema strategy,
+// objects are created in the first one
+func (p *PGSQLBackend) strategySchemas(database string) []string {
+	switch p.SchemaStrategy {
+	case SchemaPublic:
+		return []string{"public"}
+	case SchemaBoth:
+		return []string{database, "public"}
+	default:
+		return []string{database}
+	}
 }
 
-// This is basic escape function used only for passwords
-func (p *PGSQLBackend) escape(value string) string {
-	value = strings.Replace(value, "'", `\'`, -1)
-	value = strings.Replace(value, "\"", `\"`, -1)
-	return value
+// schemas returns schemas the users of existing database work in, objects are created in the first one.
+// The strategy can be changed after the database was created so the schemas are detected in the database,
+// it has to be connected. Schema named after the database is used if it exists, public one if it's owned
+// by the owner of the database or if there is no other schema.
+func (p *PGSQLBackend) schemas(database string) ([]string, error) {
+	schemas, err := p.queryStrings(`SELECT n.nspname FROM pg_namespace n JOIN pg_database d ON d.datname = $1
+		WHERE n.nspname = $1 OR (n.nspname = 'public' AND n.nspowner = d.datdba)
+		ORDER BY n.nspname = 'public';`, database)
+	if err != nil {
+		return nil, err
+	}
+	if len(schemas) == 0 {
+		return []string{"public"}, nil
+	}
+	return schemas, nil
 }
 
-// Close closes connection to the database
-func (p *PGSQLBackend) close() error {
-	return p.db.Close()
+// searchPathSQL returns SQL queries setting search_path of the user in the database to its schemas
+func searchPathSQL(user, database string, schemas []string) []string {
+	if schemas[0] == "public" {
+		return nil
+	}
+	return []string{"ALTER ROLE " + ident(user) + " IN DATABASE " + ident(database) + " SET search_path = " + ident(schemas[0]) + ", public;"}
+}
+
+// schemaSQL returns SQL queries preparing schemas of new database, they are run connected to it.
+// Nobody except the owner can create objects in public schema.
+func (p *PGSQLBackend) schemaSQL(database, owner string) []string {
+	sqls := []string{"REVOKE CREATE ON SCHEMA public FROM PUBLIC;"}
+	if p.SchemaStrategy == SchemaPublic || p.SchemaStrategy == SchemaBoth {
+		sqls = append(sqls, "ALTER SCHEMA public OWNER TO "+ident(owner)+";")
+	}
+	if p.SchemaStrategy != SchemaPublic {
+		sqls = append(sqls, "CREATE SCHEMA "+ident(database)+" AUTHORIZATION "+ident(owner)+";")
+	}
+	return append(sqls, searchPathSQL(owner, database, p.strategySchemas(database))...)
 }
 
 func (p *PGSQLBackend) CreateUser(user, password, database string) error {
-	if p.testValue(user) != nil {
-		return errors.New("invalid format of username")
+	user, database = foldName(user), foldName(database)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
 	}
-	if p.testValue(database) != nil {
-		return errors.New("invalid format of database")
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
 	}
 
 	if err := p.connect(p.Username); err != nil {
@@ -83,20 +348,50 @@ func (p *PGSQLBackend) CreateUser(user, password, database string) error {
 	}
 	defer p.close()
 
-	sql := "CREATE USER " + p.escape(user) + " WITH PASSWORD '" + password + "';"
+	sql := "CREATE USER " + ident(user) + " WITH PASSWORD " + literal(password) + ";"
 	return p.execute(sql)
 }
 
+// databaseOwner returns name of the owner of the database
+func (p *PGSQLBackend) databaseOwner(database string) (string, error) {
+	owners, err := p.queryStrings("SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = $1;", database)
+	if err != nil {
+		return "", err
+	}
+	if len(owners) == 0 {
+		return "", errors.New("database " + database + " doesn't exist")
+	}
+	return owners[0], nil
+}
+
 func (p *PGSQLBackend) CreateROUser(user, password, database string) error {
-	sqls := []string{
-		fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s';", user, password),
-		fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s;", database, user),
-		fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s;", database, user),
-		fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA %s TO %s;", database, user),
-		fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT SELECT ON TABLES TO %s;", database, user),
+	user, database = foldName(user), foldName(database)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
 	}
 
-	for _, sql := range sqls {
+	// Schema privileges are local to the database so we have to be connected to it
+	if err := p.connect(database); err != nil {
+		return err
+	}
+	defer p.close()
+
+	// Default privileges have to be set for the owner who creates the tables
+	owner, err := p.databaseOwner(database)
+	if err != nil {
+		return err
+	}
+
+	schemas, err := p.schemas(database)
+	if err != nil {
+		return err
+	}
+
+	sqls := roleSQL(user, password, owner, database, schemas, roles.ReadOnly)
+	for _, sql := range append(sqls, searchPathSQL(user, database, schemas)...) {
 		err := p.execute(sql)
 		if err != nil {
 			return err
@@ -106,49 +401,207 @@ func (p *PGSQLBackend) CreateROUser(user, password, database string) error {
 	return nil
 }
 
-func (p *PGSQLBackend) CreateDatabase(database, owner string, extensions []string) error {
-	if p.testValue(owner) != nil {
-		return errors.New("invalid format of owner")
+// roleSQL returns SQL queries creating additional user of the database with privileges of the role.
+// Owner role is a member of the owner and its sessions in the database run as the owner so objects it creates
+// belong to the owner. Migrations role gets privileges on the schemas only, PostgreSQL allows changing structure
+// of existing objects to their owner, so it can change objects it creates and data of all of them.
+func roleSQL(user, password, owner, database string, schemas []string, role roles.Role) []string {
+	sqls := []string{
+		"CREATE USER " + ident(user) + " WITH PASSWORD " + literal(password) + ";",
+		"GRANT CONNECT ON DATABASE " + ident(database) + " TO " + ident(user) + ";",
 	}
-	if p.testValue(database) != nil {
-		return errors.New("invalid format of database")
+
+	if role == roles.Owner {
+		sqls = append(sqls,
+			"GRANT "+ident(owner)+" TO "+ident(user)+";",
+			"ALTER ROLE "+ident(user)+" IN DATABASE "+ident(database)+" SET role = "+ident(owner)+";",
+		)
 	}
-	for _, extension := range extensions {
-		if p.testValue(extension) != nil {
-			return errors.New("invalid format of extension")
+
+	for _, schema := range schemas {
+		switch role {
+		case roles.ReadWrite:
+			sqls = append(sqls,
+				"GRANT USAGE ON SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(owner)+" IN SCHEMA "+ident(schema)+" GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO "+ident(user)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(owner)+" IN SCHEMA "+ident(schema)+" GRANT USAGE, SELECT ON SEQUENCES TO "+ident(user)+";",
+			)
+		case roles.ReadOnly:
+			sqls = append(sqls,
+				"GRANT USAGE ON SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"GRANT SELECT ON ALL TABLES IN SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(owner)+" IN SCHEMA "+ident(schema)+" GRANT SELECT ON TABLES TO "+ident(user)+";",
+			)
+		case roles.Migrations:
+			// Owner gets all privileges on objects created by the user
+			sqls = append(sqls,
+				"GRANT USAGE, CREATE ON SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA "+ident(schema)+" TO "+ident(user)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(owner)+" IN SCHEMA "+ident(schema)+" GRANT ALL PRIVILEGES ON TABLES TO "+ident(user)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(owner)+" IN SCHEMA "+ident(schema)+" GRANT ALL PRIVILEGES ON SEQUENCES TO "+ident(user)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(user)+" IN SCHEMA "+ident(schema)+" GRANT ALL PRIVILEGES ON TABLES TO "+ident(owner)+";",
+				"ALTER DEFAULT PRIVILEGES FOR ROLE "+ident(user)+" IN SCHEMA "+ident(schema)+" GRANT ALL PRIVILEGES ON SEQUENCES TO "+ident(owner)+";",
+			)
 		}
 	}
 
-	if err := p.connect(p.Username); err != nil {
+	return sqls
+}
+
+// CreateExtraUser creates additional user of the database with privileges of the role
+func (p *PGSQLBackend) CreateExtraUser(user, password, database string, role roles.Role) error {
+	user, database = foldName(user), foldName(database)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	if err := role.Validate(); err != nil {
 		return err
 	}
 
-	sql := "CREATE DATABASE " + database + " OWNER " + owner + ";"
-	err := p.execute(sql)
+	// Schema privileges are local to the database so we have to be connected to it
+	if err := p.connect(database); err != nil {
+		return err
+	}
+	defer p.close()
+
+	owner, err := p.databaseOwner(database)
+	if err != nil {
+		return err
+	}
+
+	schemas, err := p.schemas(database)
 	if err != nil {
 		return err
 	}
-	p.close()
+
+	sqls := roleSQL(user, password, owner, database, schemas, role)
+	for _, sql := range append(sqls, searchPathSQL(user, database, schemas)...) {
+		err := p.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropExtraUser drops additional user of the database. Objects it owns in the database are given
+// to the owner of the database first so they are not dropped with the user.
+func (p *PGSQLBackend) DropExtraUser(user, database string) error {
+	user, database = foldName(user), foldName(database)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
 
 	if err := p.connect(database); err != nil {
 		return err
 	}
 	defer p.close()
 
-	sql = "CREATE SCHEMA " + database + ";"
-	err = p.execute(sql)
+	owner, err := p.databaseOwner(database)
 	if err != nil {
 		return err
 	}
 
-	sql = "ALTER SCHEMA " + database + " OWNER TO " + owner + ";"
-	err = p.execute(sql)
+	sqls := []string{
+		"REASSIGN OWNED BY " + ident(user) + " TO " + ident(owner) + ";",
+		"DROP OWNED BY " + ident(user) + ";",
+		"DROP ROLE " + ident(user) + ";",
+	}
+
+	for _, sql := range sqls {
+		err := p.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Users returns names of users allowed to connect to the database
+func (p *PGSQLBackend) Users(database string) ([]string, error) {
+	database = foldName(database)
+	if err := p.testValue(database); err != nil {
+		return nil, errors.Wrap(err, "invalid format of database")
+	}
+
+	if err := p.connect(p.Username); err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	// Without explicit grants the owner has the default privileges, PUBLIC (grantee 0) is skipped by the join
+	sql := `SELECT DISTINCT r.rolname FROM pg_database d
+		CROSS JOIN LATERAL aclexplode(coalesce(d.datacl, acldefault('d', d.datdba))) a
+		JOIN pg_roles r ON r.oid = a.grantee
+		WHERE d.datname = $1 AND a.privilege_type = 'CONNECT' ORDER BY 1;`
+	return p.queryStrings(sql, database)
+}
+
+func (p *PGSQLBackend) CreateDatabase(database, owner string, extensions []string, options dboptions.Options) error {
+	database, owner = foldName(database), foldName(owner)
+	if err := p.testValue(owner); err != nil {
+		return errors.Wrap(err, "invalid format of owner")
+	}
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	for _, extension := range extensions {
+		if err := p.testValue(extension); err != nil {
+			return errors.Wrap(err, "invalid format of extension")
+		}
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	if err := p.connect(p.Username); err != nil {
+		return err
+	}
+
+	err := p.checkOptions(options)
 	if err != nil {
+		p.close()
+		return err
+	}
+
+	// Other users can't connect to the database unless they get CONNECT privilege
+	sqls := append([]string{
+		"CREATE DATABASE " + ident(database) + " OWNER " + ident(owner) + optionsSQL(options) + ";",
+	}, isolationSQL(database, owner)...)
+	for _, sql := range sqls {
+		err = p.execute(sql)
+		if err != nil {
+			p.close()
+			return err
+		}
+	}
+	p.close()
+
+	if err := p.connect(database); err != nil {
 		return err
 	}
+	defer p.close()
+
+	for _, sql := range p.schemaSQL(database, owner) {
+		err := p.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
 
 	for _, extension := range extensions {
-		sql := "CREATE EXTENSION " + extension + " SCHEMA " + database + ";"
+		sql := "CREATE EXTENSION " + ident(extension) + " SCHEMA " + ident(p.strategySchemas(database)[0]) + ";"
 		err := p.execute(sql)
 		if err != nil {
 			return err
@@ -158,9 +611,118 @@ func (p *PGSQLBackend) CreateDatabase(database, owner string, extensions []strin
 	return nil
 }
 
+// isolationSQL returns SQL queries allowing only the owner and users with explicit grant to connect to the database
+func isolationSQL(database, owner string) []string {
+	return []string{
+		"GRANT CONNECT ON DATABASE " + ident(database) + " TO " + ident(owner) + ";",
+		"REVOKE CONNECT ON DATABASE " + ident(database) + " FROM PUBLIC;",
+	}
+}
+
+// Harden revokes CONNECT privilege from PUBLIC on existing databases created before it was done
+// for all new ones, databases for which skip returns true are left alone. It returns descriptions
+// of all changes.
+func (p *PGSQLBackend) Harden(skip func(database string) bool) ([]string, error) {
+	if err := p.connect(p.Username); err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	// PUBLIC is grantee 0, databases without ACL have default privileges with CONNECT for PUBLIC
+	rows, err := p.queryRows(`SELECT d.datname, pg_get_userbyid(d.datdba) FROM pg_database d
+		WHERE NOT d.datistemplate AND EXISTS (
+			SELECT 1 FROM aclexplode(coalesce(d.datacl, acldefault('d', d.datdba))) a
+			WHERE a.grantee = 0 AND a.privilege_type = 'CONNECT'
+		) ORDER BY d.datname;`)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []string{}
+	for _, row := range rows {
+		database, owner := row[0], row[1]
+		if skip(database) {
+			continue
+		}
+
+		for _, sql := range isolationSQL(database, owner) {
+			err := p.execute(sql)
+			if err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, "database "+database+": CONNECT revoked from PUBLIC and granted to "+owner)
+	}
+
+	return changes, nil
+}
+
+// ChangeDatabaseOptions is not supported, PostgreSQL can't change encoding or collation of existing database
+func (p *PGSQLBackend) ChangeDatabaseOptions(database string, options dboptions.Options) error {
+	return errors.New("changing charset or collation of existing database is not supported by PostgreSQL")
+}
+
+// checkOptions checks the server knows the encoding and template. Locales are checked by CREATE DATABASE
+// itself, pg_collation contains only names normalized by initdb like cs_CZ.utf8 and it contains ICU
+// collations that can't be used as LC_COLLATE.
+func (p *PGSQLBackend) checkOptions(options dboptions.Options) error {
+	checks := []struct {
+		value   string
+		query   string
+		message string
+	}{
+		{options.Charset, "SELECT pg_encoding_to_char(pg_char_to_encoding($1)) WHERE pg_char_to_encoding($1) >= 0;", "encoding"},
+		{options.Template, "SELECT datname FROM pg_database WHERE datname = $1 AND datistemplate;", "template"},
+	}
+
+	for _, check := range checks {
+		if check.value == "" {
+			continue
+		}
+		values, err := p.queryStrings(check.query, check.value)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			return errors.New(check.message + " " + check.value + " is not supported by the server")
+		}
+	}
+
+	return nil
+}
+
+// optionsSQL returns options part of CREATE DATABASE statement
+func optionsSQL(options dboptions.Options) string {
+	template := options.Template
+	// Template with different encoding or locale than the server's default has to be template0
+	if template == "" && (options.Charset != "" || options.Locale != "" || options.Collation != "") {
+		template = "template0"
+	}
+
+	sql := ""
+	if template != "" {
+		sql += " TEMPLATE " + ident(template)
+	}
+	if options.Charset != "" {
+		sql += " ENCODING " + literal(options.Charset)
+	}
+	collation := options.Locale
+	if options.Collation != "" {
+		collation = options.Collation
+	}
+	if collation != "" {
+		sql += " LC_COLLATE " + literal(collation)
+	}
+	if options.Locale != "" {
+		sql += " LC_CTYPE " + literal(options.Locale)
+	}
+	return sql
+}
+
 func (p *PGSQLBackend) ChangePassword(user, password string) error {
-	if p.testValue(user) != nil {
-		return errors.New("invalid format of username")
+	user = foldName(user)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
 	}
 
 	if err := p.connect(p.Username); err != nil {
@@ -168,13 +730,14 @@ func (p *PGSQLBackend) ChangePassword(user, password string) error {
 	}
 	defer p.close()
 
-	sql := "ALTER USER " + p.escape(user) + " PASSWORD '" + password + "';"
+	sql := "ALTER USER " + ident(user) + " PASSWORD " + literal(password) + ";"
 	return p.execute(sql)
 }
 
 func (p *PGSQLBackend) DropUser(user string) error {
-	if p.testValue(user) != nil {
-		return errors.New("invalid format of username")
+	user = foldName(user)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
 	}
 
 	if err := p.connect(p.Username); err != nil {
@@ -182,23 +745,52 @@ func (p *PGSQLBackend) DropUser(user string) error {
 	}
 	defer p.close()
 
-	sql := "DROP OWNED BY " + p.escape(user) + " CASCADE;"
+	sql := "DROP OWNED BY " + ident(user) + " CASCADE;"
 	err := p.execute(sql)
 	if err != nil {
 		return err
 	}
 
-	sql = "DROP ROLE " + p.escape(user) + ";"
+	sql = "DROP ROLE " + ident(user) + ";"
 	err = p.execute(sql)
 	return err
 }
 
-func (p *PGSQLBackend) DropDatabase(database string) error {
-	// Is this needed?
-	// self.get_connection().set_isolation_level(psycopg2.extensions.ISOLATION_LEVEL_AUTOCOMMIT)
+// DropROUser drops read-only user of existing database. Its privileges are local
+// to the database so they are revoked while we are connected to it.
+func (p *PGSQLBackend) DropROUser(user, database string) error {
+	user, database = foldName(user), foldName(database)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+
+	if err := p.connect(database); err != nil {
+		return err
+	}
+	defer p.close()
+
+	sqls := []string{
+		"DROP OWNED BY " + ident(user) + ";",
+		"DROP ROLE " + ident(user) + ";",
+	}
+
+	for _, sql := range sqls {
+		err := p.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	if p.testValue(database) != nil {
-		return errors.New("invalid format of database")
+func (p *PGSQLBackend) DropDatabase(database string) error {
+	database = foldName(database)
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
 	}
 
 	if err := p.connect(p.Username); err != nil {
@@ -206,12 +798,188 @@ func (p *PGSQLBackend) DropDatabase(database string) error {
 	}
 	defer p.close()
 
-	sql := "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '" + database + "';"
-	err := p.execute(sql)
+	sql := "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1;"
+	err := p.execute(sql, database)
 	if err != nil {
 		return err
 	}
-	sql = "DROP DATABASE " + database + ";"
+	sql = "DROP DATABASE " + ident(database) + ";"
 	err = p.execute(sql)
 	return err
 }
+
+// sessionsQuery returns query terminating backends of the user or connected to the database, empty values match nothing
+func sessionsQuery(user, database string) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if user != "" {
+		args = append(args, user)
+		conditions = append(conditions, "usename = $"+strconv.Itoa(len(args)))
+	}
+	if database != "" {
+		args = append(args, database)
+		conditions = append(conditions, "datname = $"+strconv.Itoa(len(args)))
+	}
+	return "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE (" + strings.Join(conditions, " OR ") + ") AND pid <> pg_backend_pid();", args
+}
+
+// TerminateSessions terminates all backends of the user or connected to the database
+func (p *PGSQLBackend) TerminateSessions(user, database string) error {
+	user, database = foldName(user), foldName(database)
+	if user == "" && database == "" {
+		return errors.New("user or database is required")
+	}
+	if user != "" {
+		if err := p.testValue(user); err != nil {
+			return errors.Wrap(err, "invalid format of username")
+		}
+	}
+	if database != "" {
+		if err := p.testValue(database); err != nil {
+			return errors.Wrap(err, "invalid format of database")
+		}
+	}
+
+	if err := p.connect(p.Username); err != nil {
+		return err
+	}
+	defer p.close()
+
+	query, args := sessionsQuery(user, database)
+	return p.execute(query, args...)
+}
+
+// SetLimits sets resource limits of the user, zero values remove the limits
+func (p *PGSQLBackend) SetLimits(user string, userLimits limits.Limits) error {
+	user = foldName(user)
+	if err := p.testValue(user); err != nil {
+		return errors.Wrap(err, "invalid format of username")
+	}
+	if err := userLimits.Validate(); err != nil {
+		return err
+	}
+	if userLimits.MaxQueriesPerHour != 0 || userLimits.MaxUpdatesPerHour != 0 {
+		return errors.New("max_queries_per_hour and max_updates_per_hour limits are not supported by PostgreSQL")
+	}
+
+	if err := p.connect(p.Username); err != nil {
+		return err
+	}
+	defer p.close()
+
+	for _, sql := range limitsSQL(user, userLimits) {
+		err := p.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// limitsSQL returns statements setting resource limits of the user
+func limitsSQL(user string, userLimits limits.Limits) []string {
+	// 0 means no connections are allowed in PostgreSQL, -1 is unlimited
+	connectionLimit := userLimits.MaxConnections
+	if connectionLimit == 0 {
+		connectionLimit = -1
+	}
+
+	sqls := []string{"ALTER ROLE " + ident(user) + " CONNECTION LIMIT " + strconv.Itoa(connectionLimit) + ";"}
+
+	if userLimits.StatementTimeout > 0 {
+		sqls = append(sqls, "ALTER ROLE "+ident(user)+" SET statement_timeout = "+strconv.Itoa(userLimits.StatementTimeout)+";")
+	} else {
+		sqls = append(sqls, "ALTER ROLE "+ident(user)+" RESET statement_timeout;")
+	}
+
+	if userLimits.WorkMem != "" {
+		sqls = append(sqls, "ALTER ROLE "+ident(user)+" SET work_mem = "+literal(userLimits.WorkMem)+";")
+	} else {
+		sqls = append(sqls, "ALTER ROLE "+ident(user)+" RESET work_mem;")
+	}
+
+	return sqls
+}
+
+// ChangeExtensions installs extensions missing in the database, updates the installed ones
+// to their latest version and drops extensions in remove
+func (p *PGSQLBackend) ChangeExtensions(database string, install, remove []string) error {
+	database = foldName(database)
+	if err := p.testValue(database); err != nil {
+		return errors.Wrap(err, "invalid format of database")
+	}
+	for _, extension := range append(append([]string{}, install...), remove...) {
+		if err := p.testValue(extension); err != nil {
+			return errors.Wrap(err, "invalid format of extension")
+		}
+	}
+
+	if err := p.connect(database); err != nil {
+		return err
+	}
+	defer p.close()
+
+	schemas, err := p.schemas(database)
+	if err != nil {
+		return err
+	}
+
+	for _, extension := range install {
+		sqls := []string{
+			"CREATE EXTENSION IF NOT EXISTS " + ident(extension) + " SCHEMA " + ident(schemas[0]) + ";",
+			"ALTER EXTENSION " + ident(extension) + " UPDATE;",
+		}
+		for _, sql := range sqls {
+			err := p.execute(sql)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Objects depending on the extension block dropping it, they are never dropped with it
+	for _, extension := range remove {
+		sql := "DROP EXTENSION IF EXISTS " + ident(extension) + ";"
+		err := p.execute(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Extensions returns extensions installed in the database and their versions
+func (p *PGSQLBackend) Extensions(database string) (map[string]string, error) {
+	database = foldName(database)
+	if err := p.testValue(database); err != nil {
+		return nil, errors.Wrap(err, "invalid format of database")
+	}
+
+	if err := p.connect(database); err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	rows, err := p.queryRows("SELECT extname, extversion FROM pg_extension;")
+	if err != nil {
+		return nil, err
+	}
+
+	extensions := map[string]string{}
+	for _, row := range rows {
+		extensions[row[0]] = row[1]
+	}
+	return extensions, nil
+}
+
+// Ping checks the database server is available
+func (p *PGSQLBackend) Ping(ctx context.Context) error {
+	if err := p.connect(p.Username); err != nil {
+		return err
+	}
+	defer p.close()
+
+	return p.db.PingContext(ctx)
+}
@@ -0,0 +1,111 @@
+package pgsql
+
+import (
+	"testing"
+
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsSQL(t *testing.T) {
+	assert.Equal(t, []string{
+		`ALTER ROLE "test" CONNECTION LIMIT 10;`,
+		`ALTER ROLE "test" SET statement_timeout = 30000;`,
+		`ALTER ROLE "test" SET work_mem = '64MB';`,
+	}, limitsSQL("test", limits.Limits{MaxConnections: 10, StatementTimeout: 30000, WorkMem: "64MB"}))
+
+	assert.Equal(t, []string{
+		`ALTER ROLE "test" CONNECTION LIMIT -1;`,
+		`ALTER ROLE "test" RESET statement_timeout;`,
+		`ALTER ROLE "test" RESET work_mem;`,
+	}, limitsSQL("test", limits.Limits{}))
+}
+
+func TestOptionsSQL(t *testing.T) {
+	assert.Equal(t, "", optionsSQL(dboptions.Options{}))
+	assert.Equal(t, ` TEMPLATE "template_postgis"`, optionsSQL(dboptions.Options{Template: "template_postgis"}))
+	assert.Equal(t,
+		` TEMPLATE "template0" ENCODING 'UTF8' LC_COLLATE 'cs_CZ.UTF-8' LC_CTYPE 'cs_CZ.UTF-8'`,
+		optionsSQL(dboptions.Options{Charset: "UTF8", Locale: "cs_CZ.UTF-8"}),
+	)
+	assert.Equal(t,
+		` TEMPLATE "template0" LC_COLLATE 'C' LC_CTYPE 'cs_CZ.UTF-8'`,
+		optionsSQL(dboptions.Options{Locale: "cs_CZ.UTF-8", Collation: "C"}),
+	)
+}
+
+func TestRoleSQL(t *testing.T) {
+	assert.Equal(t, []string{
+		`CREATE USER "app" WITH PASSWORD 'secret';`,
+		`GRANT CONNECT ON DATABASE "test" TO "app";`,
+		`GRANT USAGE ON SCHEMA "test" TO "app";`,
+		`GRANT SELECT ON ALL TABLES IN SCHEMA "test" TO "app";`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "test" IN SCHEMA "test" GRANT SELECT ON TABLES TO "app";`,
+	}, roleSQL("app", "secret", "test", "test", []string{"test"}, roles.ReadOnly))
+
+	assert.Equal(t, []string{
+		`CREATE USER "app" WITH PASSWORD 'secret';`,
+		`GRANT CONNECT ON DATABASE "test" TO "app";`,
+		`GRANT "test" TO "app";`,
+		`ALTER ROLE "app" IN DATABASE "test" SET role = "test";`,
+	}, roleSQL("app", "secret", "test", "test", []string{"test"}, roles.Owner))
+
+	migrations := roleSQL("app", "secret", "test", "test", []string{"test"}, roles.Migrations)
+	assert.Len(t, migrations, 9)
+	assert.Contains(t, migrations, `GRANT USAGE, CREATE ON SCHEMA "test" TO "app";`)
+	assert.Contains(t, migrations, `ALTER DEFAULT PRIVILEGES FOR ROLE "app" IN SCHEMA "test" GRANT ALL PRIVILEGES ON TABLES TO "test";`)
+	assert.NotContains(t, migrations, `GRANT "test" TO "app";`)
+
+	assert.Len(t, roleSQL("app", "secret", "test", "test", []string{"test"}, roles.ReadWrite), 7)
+}
+
+func TestSchemaSQL(t *testing.T) {
+	p := &PGSQLBackend{}
+	assert.Equal(t, []string{"test"}, p.strategySchemas("test"))
+	assert.Equal(t, []string{
+		`REVOKE CREATE ON SCHEMA public FROM PUBLIC;`,
+		`CREATE SCHEMA "test" AUTHORIZATION "owner";`,
+		`ALTER ROLE "owner" IN DATABASE "test" SET search_path = "test", public;`,
+	}, p.schemaSQL("test", "owner"))
+
+	p.SchemaStrategy = SchemaPublic
+	assert.Equal(t, []string{"public"}, p.strategySchemas("test"))
+	assert.Equal(t, []string{
+		`REVOKE CREATE ON SCHEMA public FROM PUBLIC;`,
+		`ALTER SCHEMA public OWNER TO "owner";`,
+	}, p.schemaSQL("test", "owner"))
+
+	p.SchemaStrategy = SchemaBoth
+	assert.Equal(t, []string{"test", "public"}, p.strategySchemas("test"))
+	assert.Len(t, p.schemaSQL("test", "owner"), 4)
+	assert.Len(t, roleSQL("app", "secret", "owner", "test", p.strategySchemas("test"), roles.ReadOnly), 8)
+
+	assert.Empty(t, searchPathSQL("app", "test", []string{"public"}))
+	assert.Equal(t, []string{`ALTER ROLE "app" IN DATABASE "test" SET search_path = "test", public;`}, searchPathSQL("app", "test", []string{"test", "public"}))
+}
+
+func TestIsolationSQL(t *testing.T) {
+	assert.Equal(t, []string{
+		`GRANT CONNECT ON DATABASE "test" TO "owner";`,
+		`REVOKE CONNECT ON DATABASE "test" FROM PUBLIC;`,
+	}, isolationSQL("test", "owner"))
+}
+
+func TestFoldName(t *testing.T) {
+	assert.Equal(t, "test_db.1", foldName("Test_DB.1"))
+	assert.Equal(t, "My DB", foldName("My DB"))
+	assert.Equal(t, "Ěšč", foldName("Ěšč"))
+	assert.Equal(t, "", foldName(""))
+}
+
+func TestSessionsQuery(t *testing.T) {
+	query, args := sessionsQuery("", "test")
+	assert.Equal(t, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE (datname = $1) AND pid <> pg_backend_pid();", query)
+	assert.Equal(t, []interface{}{"test"}, args)
+
+	query, args = sessionsQuery("test", "test")
+	assert.Equal(t, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE (usename = $1 OR datname = $2) AND pid <> pg_backend_pid();", query)
+	assert.Equal(t, []interface{}{"test", "test"}, args)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+)
+
+// System databases and users protected on every server of the type, pattern ending with * matches a prefix
+var builtinProtected = map[string][]string{
+	"mysql": {
+		"mysql", "information_schema", "performance_schema", "sys",
+		"root", "mysql.*", "mariadb.sys", "debian-sys-maint",
+	},
+	"mariadb": {
+		"mysql", "information_schema", "performance_schema", "sys",
+		"root", "mysql.*", "mariadb.sys", "debian-sys-maint",
+	},
+	"pgsql": {
+		"postgres", "template0", "template1", "pg_*",
+	},
+}
+
+// State reported to the admin when an event tries to change a protected name
+const protectedState = "protected name"
+
+// ProtectedError is returned when an event tries to change a protected database or user
+type ProtectedError struct {
+	Name string
+}
+
+func (e *ProtectedError) Error() string {
+	return "name " + e.Name + " is protected"
+}
+
+// errorState returns state reported to the admin for an error returned by a backend
+func errorState(err error) string {
+	if _, ok := errors.Cause(err).(*ProtectedError); ok {
+		return protectedState
+	}
+	return "backend problem"
+}
+
+// matchName returns true if the name matches the pattern, names are compared case insensitive
+func matchName(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == name
+}
+
+// IsProtected returns true if the database or user can't be changed by events.
+// Built-in system names, the admin user of the server and names from the config are protected.
+func (d *DatabaseLine) IsProtected(name string) bool {
+	if strings.EqualFold(name, d.Username) {
+		return true
+	}
+
+	for _, pattern := range builtinProtected[d.DBType] {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+	for _, pattern := range d.Protected {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// protectedBackend refuses all changes of protected names before they get to the wrapped backend
+type protectedBackend struct {
+	Backend
+	databaseLine DatabaseLine
+}
+
+func (p *protectedBackend) check(names ...string) error {
+	for _, name := range names {
+		if p.databaseLine.IsProtected(name) {
+			return &ProtectedError{Name: name}
+		}
+	}
+	return nil
+}
+
+func (p *protectedBackend) CreateUser(user, password, database string) error {
+	if err := p.check(user, database); err != nil {
+		return err
+	}
+	return p.Backend.CreateUser(user, password, database)
+}
+
+func (p *protectedBackend) CreateROUser(user, password, database string) error {
+	if err := p.check(user, database); err != nil {
+		return err
+	}
+	return p.Backend.CreateROUser(user, password, database)
+}
+
+func (p *protectedBackend) CreateDatabase(database, owner string, extensions []string, options dboptions.Options) error {
+	if err := p.check(database, owner); err != nil {
+		return err
+	}
+	return p.Backend.CreateDatabase(database, owner, extensions, options)
+}
+
+func (p *protectedBackend) ChangeDatabaseOptions(database string, options dboptions.Options) error {
+	if err := p.check(database); err != nil {
+		return err
+	}
+	return p.Backend.ChangeDatabaseOptions(database, options)
+}
+
+func (p *protectedBackend) ChangePassword(user, password string) error {
+	if err := p.check(user); err != nil {
+		return err
+	}
+	return p.Backend.ChangePassword(user, password)
+}
+
+func (p *protectedBackend) DropUser(user string) error {
+	if err := p.check(user); err != nil {
+		return err
+	}
+	return p.Backend.DropUser(user)
+}
+
+func (p *protectedBackend) DropROUser(user, database string) error {
+	if err := p.check(user, database); err != nil {
+		return err
+	}
+	return p.Backend.DropROUser(user, database)
+}
+
+func (p *protectedBackend) DropDatabase(database string) error {
+	if err := p.check(database); err != nil {
+		return err
+	}
+	return p.Backend.DropDatabase(database)
+}
+
+func (p *protectedBackend) SetLimits(user string, userLimits limits.Limits) error {
+	if err := p.check(user); err != nil {
+		return err
+	}
+	return p.Backend.SetLimits(user, userLimits)
+}
+
+func (p *protectedBackend) ChangeExtensions(database string, install, remove []string) error {
+	if err := p.check(database); err != nil {
+		return err
+	}
+	return p.Backend.ChangeExtensions(database, install, remove)
+}
+
+func (p *protectedBackend) CreateExtraUser(user, password, database string, role roles.Role) error {
+	if err := p.check(user, database); err != nil {
+		return err
+	}
+	return p.Backend.CreateExtraUser(user, password, database, role)
+}
+
+func (p *protectedBackend) DropExtraUser(user, database string) error {
+	if err := p.check(user, database); err != nil {
+		return err
+	}
+	return p.Backend.DropExtraUser(user, database)
+}
+
+// TerminateSessions checks only names that are set, empty one means any user or database
+func (p *protectedBackend) TerminateSessions(user, database string) error {
+	for _, name := range []string{user, database} {
+		if name == "" {
+			continue
+		}
+		if err := p.check(name); err != nil {
+			return err
+		}
+	}
+	return p.Backend.TerminateSessions(user, database)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend records names of called methods
+type fakeBackend struct {
+	calls []string
+}
+
+func (f *fakeBackend) CreateUser(user, password, database string) error {
+	f.calls = append(f.calls, "CreateUser")
+	return nil
+}
+func (f *fakeBackend) CreateROUser(user, password, database string) error {
+	f.calls = append(f.calls, "CreateROUser")
+	return nil
+}
+func (f *fakeBackend) CreateDatabase(database, owner string, extensions []string, options dboptions.Options) error {
+	f.calls = append(f.calls, "CreateDatabase")
+	return nil
+}
+func (f *fakeBackend) ChangeDatabaseOptions(database string, options dboptions.Options) error {
+	f.calls = append(f.calls, "ChangeDatabaseOptions")
+	return nil
+}
+func (f *fakeBackend) ChangePassword(user, password string) error {
+	f.calls = append(f.calls, "ChangePassword")
+	return nil
+}
+func (f *fakeBackend) DropUser(user string) error {
+	f.calls = append(f.calls, "DropUser")
+	return nil
+}
+func (f *fakeBackend) DropROUser(user, database string) error {
+	f.calls = append(f.calls, "DropROUser")
+	return nil
+}
+func (f *fakeBackend) DropDatabase(database string) error {
+	f.calls = append(f.calls, "DropDatabase")
+	return nil
+}
+func (f *fakeBackend) SetLimits(user string, userLimits limits.Limits) error {
+	f.calls = append(f.calls, "SetLimits")
+	return nil
+}
+func (f *fakeBackend) ChangeExtensions(database string, install, remove []string) error {
+	f.calls = append(f.calls, "ChangeExtensions")
+	return nil
+}
+func (f *fakeBackend) Extensions(database string) (map[string]string, error) {
+	return nil, nil
+}
+func (f *fakeBackend) CreateExtraUser(user, password, database string, role roles.Role) error {
+	f.calls = append(f.calls, "CreateExtraUser")
+	return nil
+}
+func (f *fakeBackend) DropExtraUser(user, database string) error {
+	f.calls = append(f.calls, "DropExtraUser")
+	return nil
+}
+func (f *fakeBackend) Users(database string) ([]string, error) {
+	return nil, nil
+}
+func (f *fakeBackend) TerminateSessions(user, database string) error {
+	f.calls = append(f.calls, "TerminateSessions")
+	return nil
+}
+func (f *fakeBackend) Ping(ctx context.Context) error { return nil }
+func (f *fakeBackend) ClosePool() error               { return nil }
+
+func TestProtectedNames(t *testing.T) {
+	databaseLine := DatabaseLine{DBType: "mysql", Username: "rosti", Protected: []string{"billing", "internal_*"}}
+
+	for _, name := range []string{"mysql", "INFORMATION_SCHEMA", "mysql.sys", "root", "rosti", "billing", "internal_stats"} {
+		assert.True(t, databaseLine.IsProtected(name), name)
+	}
+	for _, name := range []string{"test1", "mysqlx", "billing2", "internal"} {
+		assert.False(t, databaseLine.IsProtected(name), name)
+	}
+
+	databaseLine = DatabaseLine{DBType: "pgsql", Username: "rosti"}
+	assert.True(t, databaseLine.IsProtected("postgres"))
+	assert.True(t, databaseLine.IsProtected("template1"))
+	assert.True(t, databaseLine.IsProtected("pg_monitor"))
+	assert.False(t, databaseLine.IsProtected("mysql"))
+}
+
+func TestProtectedBackend(t *testing.T) {
+	fake := &fakeBackend{}
+	backend := &protectedBackend{Backend: fake, databaseLine: DatabaseLine{DBType: "pgsql", Username: "rosti"}}
+
+	err := backend.DropDatabase("postgres")
+	assert.Equal(t, &ProtectedError{Name: "postgres"}, err)
+	assert.Equal(t, protectedState, errorState(errors.Wrap(err, "drop")))
+	assert.NotNil(t, backend.DropUser("rosti"))
+	assert.NotNil(t, backend.ChangePassword("pg_read_all_data", "secret"))
+	assert.NotNil(t, backend.CreateUser("test1", "secret", "template1"))
+	assert.NotNil(t, backend.CreateDatabase("test1", "postgres", nil, dboptions.Options{}))
+	assert.NotNil(t, backend.ChangeDatabaseOptions("template1", dboptions.Options{Charset: "UTF8"}))
+	assert.NotNil(t, backend.CreateROUser("pg_monitor", "secret", "test1"))
+	assert.NotNil(t, backend.SetLimits("postgres", limits.Limits{MaxConnections: 10}))
+	assert.NotNil(t, backend.ChangeExtensions("template1", []string{"hstore"}, nil))
+	assert.NotNil(t, backend.DropROUser("test1_ro", "postgres"))
+	assert.NotNil(t, backend.CreateExtraUser("rosti", "secret", "test1", roles.ReadOnly))
+	assert.NotNil(t, backend.DropExtraUser("test1_app", "template0"))
+	assert.NotNil(t, backend.TerminateSessions("", "postgres"))
+	assert.Empty(t, fake.calls)
+
+	assert.Nil(t, backend.DropDatabase("test1"))
+	assert.Nil(t, backend.DropUser("test1"))
+	assert.Nil(t, backend.TerminateSessions("test1", ""))
+	assert.Equal(t, []string{"DropDatabase", "DropUser", "TerminateSessions"}, fake.calls)
+	assert.Equal(t, "backend problem", errorState(errors.New("SQL error")))
+}
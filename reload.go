@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// Time after which connection pool with old credentials is closed so running events can finish
+const poolCloseDelay = time.Minute
+
+// Subscriptions of all database servers, key is alias:dbtype
+var subscriptions = map[string]*nats.Subscription{}
+var subscriptionsLock sync.Mutex
+
+// reloadLock makes sure only one reload runs at the same time
+var reloadLock sync.Mutex
+
+// Interval of checks whether a draining subscription is closed
+const drainCheckInterval = 100 * time.Millisecond
+
+// drainingServer is a server removed from the config, events received before the removal still use it
+type drainingServer struct {
+	databaseLine DatabaseLine
+	subscription *nats.Subscription // nil while the config is being reloaded
+}
+
+// Removed servers kept until their subscriptions are drained, key is alias:dbtype
+var drainingServers = map[string]drainingServer{}
+var drainingLock sync.Mutex
+
+// serverConfig returns the database server of the event, removed servers are returned until their subscriptions are drained
+func serverConfig(alias, dbtype string) DatabaseLine {
+	key := alias + ":" + dbtype
+	if databaseLine, ok := config.DatabasesMap()[key]; ok {
+		return databaseLine
+	}
+
+	drainingLock.Lock()
+	defer drainingLock.Unlock()
+	return drainingServers[key].databaseLine
+}
+
+// keepServers keeps the servers available to serverConfig while the config is reloaded
+func keepServers(servers map[string]DatabaseLine) {
+	drainingLock.Lock()
+	defer drainingLock.Unlock()
+	for key, databaseLine := range servers {
+		drainingServers[key] = drainingServer{databaseLine: databaseLine}
+	}
+}
+
+// releaseServers forgets servers kept by keepServers which don't wait for their subscriptions to be drained
+func releaseServers() {
+	drainingLock.Lock()
+	defer drainingLock.Unlock()
+	for key, server := range drainingServers {
+		if server.subscription == nil {
+			delete(drainingServers, key)
+		}
+	}
+}
+
+// waitForDrain keeps the removed server until its subscription is closed after the last event is processed
+func waitForDrain(databaseLine DatabaseLine, subscription *nats.Subscription) {
+	drainingLock.Lock()
+	drainingServers[databaseLine.Key()] = drainingServer{databaseLine: databaseLine, subscription: subscription}
+	drainingLock.Unlock()
+
+	go func() {
+		for subscription.IsValid() {
+			time.Sleep(drainCheckInterval)
+		}
+
+		drainingLock.Lock()
+		defer drainingLock.Unlock()
+		// The server could be removed again in the meantime
+		if drainingServers[databaseLine.Key()].subscription == subscription {
+			delete(drainingServers, databaseLine.Key())
+		}
+	}()
+}
+
+// subscribe starts listening for events of the database server
+func subscribe(databaseLine DatabaseLine) {
+	subject := fmt.Sprintf(subscribeTemplate, databaseLine.DBType, databaseLine.Alias)
+
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+
+	logger.With(Fields{"subject": subject}).Info("listening")
+	subscription, err := nc.Subscribe(subject, messageHandler)
+	if err != nil {
+		logger.With(Fields{"subject": subject}).WithError(err).Error("subscribe error")
+		return
+	}
+	subscriptions[databaseLine.Key()] = subscription
+}
+
+// unsubscribe stops listening for events of the database server, events already received are processed first
+func unsubscribe(databaseLine DatabaseLine) {
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+
+	subscription, ok := subscriptions[databaseLine.Key()]
+	if !ok {
+		return
+	}
+	delete(subscriptions, databaseLine.Key())
+
+	logger.With(Fields{"subject": subscription.Subject}).Info("draining subscription")
+	err := subscription.Drain()
+	if err != nil {
+		logger.With(Fields{"subject": subscription.Subject}).WithError(err).Error("drain error")
+		return
+	}
+	waitForDrain(databaseLine, subscription)
+}
+
+// closePoolLater closes connection pool of the database server after poolCloseDelay
+func closePoolLater(databaseLine DatabaseLine) {
+	backend, err := newBackend(databaseLine, nil)
+	if err != nil {
+		return
+	}
+	time.AfterFunc(poolCloseDelay, func() {
+		err := backend.ClosePool()
+		if err != nil {
+			logger.With(Fields{"alias": databaseLine.Alias, "dbtype": databaseLine.DBType}).WithError(err).Error("closing connection pool failed")
+		}
+	})
+}
+
+// reloadConfig reads the config and DATABASES_FILE again, subscribes to new servers, unsubscribes removed
+// ones and closes connection pools with old credentials. Other servers are not affected.
+// Old config stays in use if the new one is invalid.
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	oldServers := config.DatabasesMap()
+
+	// Events received before the reload find removed servers until their subscriptions are drained
+	keepServers(oldServers)
+	defer releaseServers()
+
+	oldDatabases := config.Databases
+	err := reloadDatabasesFile()
+	if err != nil {
+		return err
+	}
+	err = config.Load()
+	if err != nil {
+		config.Databases = oldDatabases
+		return err
+	}
+
+	newServers := config.DatabasesMap()
+
+	for key, newServer := range newServers {
+		oldServer, ok := oldServers[key]
+		if !ok {
+			logger.With(Fields{"alias": newServer.Alias, "dbtype": newServer.DBType}).Info("database server added")
+			subscribe(newServer)
+			continue
+		}
+
+		if oldServer.ConnectionChanged(newServer) {
+			logger.With(Fields{"alias": newServer.Alias, "dbtype": newServer.DBType}).Info("database server connection changed")
+			closePoolLater(oldServer)
+		}
+	}
+
+	for key, oldServer := range oldServers {
+		if _, ok := newServers[key]; !ok {
+			logger.With(Fields{"alias": oldServer.Alias, "dbtype": oldServer.DBType}).Info("database server removed")
+			unsubscribe(oldServer)
+			closePoolLater(oldServer)
+		}
+	}
+
+	return nil
+}
+
+// reloadDatabasesFile reads DATABASES from DATABASES_FILE again,
+// DATABASES set directly in the environment can't change without restart.
+func reloadDatabasesFile() error {
+	path := os.Getenv("DATABASES_FILE")
+	if path == "" {
+		return nil
+	}
+
+	value, err := (&fileSecretSource{}).Secret(path)
+	if err != nil {
+		return errors.Wrap(err, "DATABASES_FILE")
+	}
+	config.Databases = value
+	return nil
+}
+
+// watchConfigFile reloads the config when content of the file changes
+func watchConfigFile(path string, interval time.Duration) {
+	lastHash := []byte{}
+
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			logger.With(Fields{"path": path}).WithError(err).Error("config file can't be read")
+		} else {
+			hash := sha256.Sum256(data)
+			if len(lastHash) > 0 && !bytes.Equal(lastHash, hash[:]) {
+				logger.With(Fields{"path": path}).Info("config file changed, reloading")
+				err = reloadConfig()
+				if err != nil {
+					logger.WithError(err).Error("config reload failed")
+				}
+			}
+			lastHash = hash[:]
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfigDraining(t *testing.T) {
+	config = Config{Databases: "devpgsql:pgsql:localhost:5432:rosti:rosti;devmysql:mariadb:localhost:3306:rosti:rosti"}
+	assert.Nil(t, config.Load())
+	oldServers := config.DatabasesMap()
+
+	// Removed server is available while the config is reloaded
+	keepServers(oldServers)
+	config = Config{Databases: "devpgsql:pgsql:localhost:5432:rosti:rosti"}
+	assert.Nil(t, config.Load())
+	assert.Equal(t, "devmysql", serverConfig("devmysql", "mariadb").Alias)
+
+	// and until its subscription is drained
+	waitForDrain(oldServers["devmysql:mariadb"], &nats.Subscription{})
+	releaseServers()
+	assert.Eventually(t, func() bool {
+		return serverConfig("devmysql", "mariadb").Alias == ""
+	}, time.Second, drainCheckInterval)
+	assert.Equal(t, "devpgsql", serverConfig("devpgsql", "pgsql").Alias)
+}
+
+func TestReloadDatabasesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "databases")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("devpgsql:pgsql:localhost:5432:rosti:rosti\n"), 0600))
+	os.Setenv("DATABASES_FILE", path)
+	defer os.Unsetenv("DATABASES_FILE")
+
+	config = Config{Databases: "devpgsql:pgsql:localhost:5432:rosti:rosti"}
+	assert.Nil(t, config.Load())
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("devpgsql:pgsql:localhost:5433:rosti:rosti\n"), 0600))
+	assert.Nil(t, reloadConfig())
+	assert.Equal(t, 5433, serverConfig("devpgsql", "pgsql").Port)
+
+	// Invalid file is refused and the old servers stay
+	assert.Nil(t, ioutil.WriteFile(path, []byte("devpgsql:pgsql\n"), 0600))
+	assert.NotNil(t, reloadConfig())
+	assert.Equal(t, "devpgsql:pgsql:localhost:5433:rosti:rosti", config.Databases)
+	assert.Equal(t, 5433, serverConfig("devpgsql", "pgsql").Port)
+}
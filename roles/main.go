@@ -0,0 +1,33 @@
+// Package roles names the presets of privileges additional users get by user_added event.
+// The admin uses only these names, each backend maps them to its own GRANT statements.
+package roles
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Role is a preset of privileges of a user in a single database
+type Role string
+
+const (
+	Owner      Role = "owner"      // everything the owner of the database can do
+	ReadWrite  Role = "readwrite"  // reading and changing data (DML), no changes of the structure
+	ReadOnly   Role = "readonly"   // reading data only
+	Migrations Role = "migrations" // changes of the structure (DDL) and data for schema migrations
+)
+
+// All contains all supported roles
+var All = []Role{Owner, ReadWrite, ReadOnly, Migrations}
+
+// Validate returns error if the role is not supported
+func (r Role) Validate() error {
+	for _, role := range All {
+		if r == role {
+			return nil
+		}
+	}
+	if r == "" {
+		return errors.New("role is required")
+	}
+	return errors.New("unknown role " + string(r) + ", use owner, readwrite, readonly or migrations")
+}
@@ -0,0 +1,18 @@
+package roles
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	for _, role := range All {
+		assert.Nil(t, role.Validate())
+	}
+
+	assert.EqualError(t, Role("").Validate(), "role is required")
+	// The admin gets the list of valid presets back
+	assert.EqualError(t, Role("admin").Validate(), "unknown role admin, use owner, readwrite, readonly or migrations")
+	assert.NotNil(t, Role("Owner").Validate())
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SecretSource returns value of a secret by its path
+type SecretSource interface {
+	Secret(path string) (string, error)
+}
+
+// fileSecretSource reads secrets from local files, path is absolute path of the file
+type fileSecretSource struct{}
+
+func (f *fileSecretSource) Secret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "reading secret file")
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// systemdSecretSource reads secrets from systemd credentials directory, path is name of the credential
+type systemdSecretSource struct {
+	directory string
+}
+
+func (s *systemdSecretSource) Secret(path string) (string, error) {
+	if s.directory == "" {
+		return "", errors.New("CREDENTIALS_DIRECTORY is not set, is LoadCredential= used in the unit?")
+	}
+	if path == "" || strings.ContainsAny(path, `/\`) {
+		return "", errors.New("invalid credential name " + path)
+	}
+
+	return (&fileSecretSource{}).Secret(filepath.Join(s.directory, path))
+}
+
+// vaultSecretSource reads secrets from HashiCorp Vault compatible HTTP API,
+// path is in format mount/path#key, key is "password" if not set.
+// Both KV version 1 and 2 are supported.
+type vaultSecretSource struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func (v *vaultSecretSource) Secret(path string) (string, error) {
+	if v.address == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+
+	key := "password"
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		key = path[i+1:]
+		path = path[:i]
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(v.address, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "vault request")
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "vault request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("vault returned status " + resp.Status + " for " + path)
+	}
+
+	body := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrap(err, "vault response")
+	}
+
+	data := body.Data
+	// KV version 2 has one more level
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", errors.New("vault secret " + path + " doesn't contain key " + key)
+	}
+	return value, nil
+}
+
+// SecretResolver resolves secret references in format source:path where source is file, systemd or vault
+type SecretResolver struct {
+	sources map[string]SecretSource
+}
+
+// NewSecretResolver returns resolver with all supported sources
+func NewSecretResolver(vaultAddress, vaultToken string) *SecretResolver {
+	return &SecretResolver{
+		sources: map[string]SecretSource{
+			"file":    &fileSecretSource{},
+			"systemd": &systemdSecretSource{directory: os.Getenv("CREDENTIALS_DIRECTORY")},
+			"vault": &vaultSecretSource{
+				address: vaultAddress,
+				token:   vaultToken,
+				client:  &http.Client{Timeout: 10 * time.Second},
+			},
+		},
+	}
+}
+
+// Resolve returns value of the secret reference
+func (r *SecretResolver) Resolve(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("invalid secret reference " + ref + ", expected source:path")
+	}
+
+	source, ok := r.sources[parts[0]]
+	if !ok {
+		return "", errors.New("unknown secret source " + parts[0])
+	}
+
+	value, err := source.Secret(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "secret "+ref)
+	}
+	return value, nil
+}
+
+// loadEnvFiles sets environment variables of the config from files if VARIABLE_FILE is set,
+// e.g. NATS_TOKEN_FILE=/run/secrets/nats_token sets NATS_TOKEN. It has to be called before envconfig.Process().
+func loadEnvFiles(spec interface{}) error {
+	specType := reflect.TypeOf(spec).Elem()
+	for i := 0; i < specType.NumField(); i++ {
+		key := specType.Field(i).Tag.Get("envconfig")
+		if key == "" {
+			continue
+		}
+
+		path := os.Getenv(key + "_FILE")
+		if path == "" {
+			continue
+		}
+		if os.Getenv(key) != "" {
+			return errors.New("both " + key + " and " + key + "_FILE are set")
+		}
+
+		value, err := (&fileSecretSource{}).Secret(path)
+		if err != nil {
+			return errors.Wrap(err, key+"_FILE")
+		}
+
+		err = os.Setenv(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refreshSecrets periodically reads all secrets again so rotated passwords are used without restart
+func refreshSecrets(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		changed, err := config.RefreshSecrets()
+		if err != nil {
+			logger.WithError(err).Error("secrets refresh failed")
+		}
+
+		for _, databaseLine := range changed {
+			logger.With(Fields{"alias": databaseLine.Alias, "dbtype": databaseLine.DBType}).Info("admin password changed")
+
+			closePoolLater(databaseLine)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretResolver(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/devpgsql":
+			w.Write([]byte(`{"data": {"data": {"password": "kv2secret"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/devmysql":
+			w.Write([]byte(`{"data": {"admin": "kv1secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	directory := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(directory, "pgsql"), []byte("filesecret\n"), 0600))
+
+	resolver := NewSecretResolver(vault.URL, "root")
+	resolver.sources["systemd"] = &systemdSecretSource{directory: directory}
+
+	value, err := resolver.Resolve("vault:secret/data/devpgsql")
+	assert.Nil(t, err)
+	assert.Equal(t, "kv2secret", value)
+
+	value, err = resolver.Resolve("vault:kv/devmysql#admin")
+	assert.Nil(t, err)
+	assert.Equal(t, "kv1secret", value)
+
+	value, err = resolver.Resolve("file:" + filepath.Join(directory, "pgsql"))
+	assert.Nil(t, err)
+	assert.Equal(t, "filesecret", value)
+
+	value, err = resolver.Resolve("systemd:pgsql")
+	assert.Nil(t, err)
+	assert.Equal(t, "filesecret", value)
+
+	for _, ref := range []string{"vault:secret/data/missing", "vault:kv/devmysql#password", "systemd:../pgsql", "env:PASSWORD", "nothing"} {
+		_, err = resolver.Resolve(ref)
+		assert.NotNil(t, err, ref)
+	}
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("natstoken\n"), 0600))
+
+	os.Setenv("NATS_TOKEN_FILE", path)
+	defer os.Unsetenv("NATS_TOKEN_FILE")
+	defer os.Unsetenv("NATS_TOKEN")
+
+	assert.Nil(t, loadEnvFiles(&Config{}))
+	assert.Equal(t, "natstoken", os.Getenv("NATS_TOKEN"))
+
+	assert.NotNil(t, loadEnvFiles(&Config{}), "both variables are set now")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// Headers of signed events
+const (
+	signatureHeader = "Event-Signature" // hmac-sha256=<base64> or ed25519=<base64>
+	timestampHeader = "Event-Timestamp" // unix time in seconds
+	nonceHeader     = "Event-Nonce"     // unique random string
+)
+
+// Maximal length of the nonce so the replay cache can't eat all the memory
+const maxNonceLength = 128
+
+// Verification errors, they are reported back to the admin
+var (
+	errUnsigned         = errors.New("unsigned message")
+	errInvalidSignature = errors.New("invalid signature")
+	errExpired          = errors.New("expired message")
+	errReplayed         = errors.New("replayed message")
+)
+
+// EventVerifier checks signatures of incoming events. The signature covers subject, timestamp, nonce and
+// the payload so a message can't be sent to a different server, used after the time window or replayed.
+// More keys of both types can be active at the same time so they can be rotated.
+type EventVerifier struct {
+	hmacKeys    [][]byte
+	ed25519Keys []ed25519.PublicKey
+	required    bool
+	window      time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // nonce and time when it can be forgotten
+	now    func() time.Time
+}
+
+// NewEventVerifier returns verifier using base64 encoded HMAC secrets and Ed25519 public keys separated by comma or whitespace.
+// If required is true unsigned messages are refused, signatures are verified always.
+func NewEventVerifier(hmacKeys, ed25519Keys string, required bool, window time.Duration) (*EventVerifier, error) {
+	verifier := &EventVerifier{
+		required: required,
+		window:   window,
+		nonces:   map[string]time.Time{},
+		now:      time.Now,
+	}
+
+	for _, field := range splitKeys(hmacKeys) {
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid HMAC key")
+		}
+		if len(key) < 32 {
+			return nil, errors.New("invalid HMAC key, it has to be at least 32 bytes long")
+		}
+		verifier.hmacKeys = append(verifier.hmacKeys, key)
+	}
+
+	for _, field := range splitKeys(ed25519Keys) {
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid Ed25519 key")
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key, public key has to be 32 bytes long")
+		}
+		verifier.ed25519Keys = append(verifier.ed25519Keys, ed25519.PublicKey(key))
+	}
+
+	if required && len(verifier.hmacKeys) == 0 && len(verifier.ed25519Keys) == 0 {
+		return nil, errors.New("signing is required but there is no signing key")
+	}
+	if window <= 0 {
+		return nil, errors.New("signing window has to be positive")
+	}
+
+	return verifier, nil
+}
+
+// eventVerifier is replaced in _init() based on the config
+var eventVerifier = &EventVerifier{}
+
+// signedData returns data covered by the signature
+func signedData(subject, timestamp, nonce string, payload []byte) []byte {
+	data := bytes.Buffer{}
+	data.WriteString(subject + "\n" + timestamp + "\n" + nonce + "\n")
+	data.Write(payload)
+	return data.Bytes()
+}
+
+// Verify checks signature of the message, its timestamp and that it wasn't received before
+func (v *EventVerifier) Verify(m *nats.Msg) error {
+	signature := ""
+	if m.Header != nil {
+		signature = m.Header.Get(signatureHeader)
+	}
+	if signature == "" {
+		if v.required {
+			return errUnsigned
+		}
+		return nil
+	}
+
+	timestamp := m.Header.Get(timestampHeader)
+	nonce := m.Header.Get(nonceHeader)
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return errors.Wrap(errInvalidSignature, "invalid nonce")
+	}
+
+	err := v.verifySignature(signature, signedData(m.Subject, timestamp, nonce, m.Data))
+	if err != nil {
+		return err
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrap(errInvalidSignature, "invalid timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	now := v.now()
+	if signedAt.Before(now.Add(-v.window)) || signedAt.After(now.Add(v.window)) {
+		return errExpired
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for seen, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, seen)
+		}
+	}
+	if _, ok := v.nonces[nonce]; ok {
+		return errReplayed
+	}
+	// The timestamp check refuses the message after this time so the nonce isn't needed anymore
+	v.nonces[nonce] = signedAt.Add(v.window)
+
+	return nil
+}
+
+// verifySignature checks the signature by all keys of its type
+func (v *EventVerifier) verifySignature(signature string, data []byte) error {
+	parts := strings.SplitN(signature, "=", 2)
+	if len(parts) != 2 {
+		return errors.Wrap(errInvalidSignature, "unknown signature format")
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.Wrap(errInvalidSignature, "invalid signature encoding")
+	}
+
+	switch parts[0] {
+	case "hmac-sha256":
+		for _, key := range v.hmacKeys {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(data)
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return nil
+			}
+		}
+	case "ed25519":
+		for _, key := range v.ed25519Keys {
+			if ed25519.Verify(key, data, sig) {
+				return nil
+			}
+		}
+	default:
+		return errors.Wrap(errInvalidSignature, "unknown signature algorithm "+parts[0])
+	}
+
+	return errInvalidSignature
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSignedTestMessage(subject, nonce string, timestamp time.Time, payload []byte, sign func([]byte) string) *nats.Msg {
+	m := nats.NewMsg(subject)
+	m.Data = payload
+	m.Header.Set(timestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	m.Header.Set(nonceHeader, nonce)
+	m.Header.Set(signatureHeader, sign(signedData(subject, m.Header.Get(timestampHeader), nonce, payload)))
+	return m
+}
+
+func TestEventVerifier(t *testing.T) {
+	hmacKey := make([]byte, 32)
+	rand.Read(hmacKey)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	signHMAC := func(data []byte) string {
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write(data)
+		return "hmac-sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	signEd25519 := func(data []byte) string {
+		return "ed25519=" + base64.StdEncoding.EncodeToString(ed25519.Sign(private, data))
+	}
+
+	verifier, err := NewEventVerifier(
+		base64.StdEncoding.EncodeToString(hmacKey),
+		base64.StdEncoding.EncodeToString(public),
+		true,
+		time.Minute,
+	)
+	assert.Nil(t, err)
+	now := time.Now()
+	verifier.now = func() time.Time { return now }
+
+	subject := "admin.storages.mysql.devmysql.events"
+	payload := []byte(`{"event_type": "deleted"}`)
+
+	assert.Nil(t, verifier.Verify(newSignedTestMessage(subject, "n1", now, payload, signHMAC)))
+	assert.Nil(t, verifier.Verify(newSignedTestMessage(subject, "n2", now, payload, signEd25519)))
+
+	// Same nonce again
+	err = verifier.Verify(newSignedTestMessage(subject, "n1", now, payload, signHMAC))
+	assert.Equal(t, errReplayed, err)
+
+	err = verifier.Verify(newSignedTestMessage(subject, "n3", now.Add(-2*time.Minute), payload, signHMAC))
+	assert.Equal(t, errExpired, err)
+
+	// Message signed for another server
+	m := newSignedTestMessage("admin.storages.mysql.other.events", "n4", now, payload, signHMAC)
+	m.Subject = subject
+	assert.Equal(t, errInvalidSignature, errors.Cause(verifier.Verify(m)))
+
+	m = newSignedTestMessage(subject, "n5", now, payload, signEd25519)
+	m.Data = []byte(`{"event_type": "created"}`)
+	assert.Equal(t, errInvalidSignature, errors.Cause(verifier.Verify(m)))
+
+	assert.Equal(t, errUnsigned, verifier.Verify(nats.NewMsg(subject)))
+
+	// Nonces are forgotten after the window
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, verifier.Verify(newSignedTestMessage(subject, "n1", now, payload, signHMAC)))
+	assert.Len(t, verifier.nonces, 1)
+
+	// Unsigned messages are accepted when signing is not required
+	verifier, err = NewEventVerifier(base64.StdEncoding.EncodeToString(hmacKey), "", false, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, verifier.Verify(nats.NewMsg(subject)))
+
+	_, err = NewEventVerifier("", "", true, time.Minute)
+	assert.NotNil(t, err)
+	_, err = NewEventVerifier(base64.StdEncoding.EncodeToString([]byte("short")), "", false, time.Minute)
+	assert.NotNil(t, err)
+}
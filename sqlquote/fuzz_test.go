@@ -0,0 +1,54 @@
+//go:build go1.18
+// +build go1.18
+
+package sqlquote
+
+import (
+	"strings"
+	"testing"
+)
+
+func addSamples(f *testing.F) {
+	for _, value := range quotingSamples {
+		f.Add(value)
+	}
+}
+
+func FuzzMySQLIdentifier(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		checkQuoted(t, value, MySQL.Identifier(value), mysqlIdentifierToken)
+	})
+}
+
+func FuzzMySQLLiteral(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		checkQuoted(t, value, MySQL.Literal(value), mysqlLiteralToken)
+	})
+}
+
+func FuzzMySQLLiteralNoBackslashEscapes(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		checkMySQLLiteralNoBackslashEscapes(t, value)
+	})
+}
+
+func FuzzPostgreSQLIdentifier(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		// NUL is rejected by ValidateIdentifier
+		if strings.ContainsRune(value, 0) {
+			t.Skip()
+		}
+		checkQuoted(t, value, PostgreSQL.Identifier(value), pgsqlIdentifierToken)
+	})
+}
+
+func FuzzPostgreSQLLiteral(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		checkQuoted(t, value, PostgreSQL.Literal(value), unquotePgsqlLiteral)
+	})
+}
@@ -0,0 +1,125 @@
+// Package sqlquote builds parts of SQL queries that can't be passed as query parameters,
+// like names of databases and users or passwords in CREATE USER, for MySQL/MariaDB and PostgreSQL.
+package sqlquote
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Dialect quotes identifiers and literals for one type of database server
+type Dialect struct {
+	Name string
+
+	// MaxIdentifierLength is maximum length of identifiers in bytes, longer names are truncated by the server
+	MaxIdentifierLength int
+
+	quoteIdentifier func(string) string
+	quoteLiteral    func(string) string
+}
+
+// MySQL is dialect of MySQL and MariaDB servers
+var MySQL = Dialect{
+	Name:                "mysql",
+	MaxIdentifierLength: 64,
+	quoteIdentifier:     mysqlIdentifier,
+	quoteLiteral:        mysqlLiteral,
+}
+
+// PostgreSQL is dialect of PostgreSQL servers
+var PostgreSQL = Dialect{
+	Name:                "pgsql",
+	MaxIdentifierLength: 63,
+	quoteIdentifier:     pq.QuoteIdentifier,
+	quoteLiteral:        pgsqlLiteral,
+}
+
+// ValidateIdentifier checks the name can be used as an identifier.
+// Any character is allowed except NUL, the name can't be empty or longer than the server allows.
+func (d Dialect) ValidateIdentifier(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+	if strings.ContainsRune(name, 0) {
+		return errors.New("name contains NUL character")
+	}
+	if len(name) > d.MaxIdentifierLength {
+		return errors.Errorf("name is longer than %d bytes", d.MaxIdentifierLength)
+	}
+
+	return nil
+}
+
+// Identifier returns quoted identifier like database, user or schema name, it has to be validated by ValidateIdentifier first
+func (d Dialect) Identifier(name string) string {
+	return d.quoteIdentifier(name)
+}
+
+// Literal returns quoted string literal, e.g. a password
+func (d Dialect) Literal(value string) string {
+	return d.quoteLiteral(value)
+}
+
+// mysqlIdentifier quotes identifier with backticks, backticks inside are doubled
+func mysqlIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// mysqlLiteral quotes string literal like mysql_real_escape_string() does except quotes are doubled,
+// so the literal can't be closed early even with NO_BACKSLASH_ESCAPES SQL mode. Other special characters
+// are escaped by backslashes which are read correctly only without that mode, MySQLBackend pins sql_mode for that.
+func mysqlLiteral(value string) string {
+	var builder strings.Builder
+	builder.Grow(len(value) + 2)
+
+	builder.WriteByte('\'')
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case 0:
+			builder.WriteString(`\0`)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\r':
+			builder.WriteString(`\r`)
+		case '\x1a':
+			builder.WriteString(`\Z`)
+		case '\'':
+			builder.WriteString(`''`)
+		case '"':
+			builder.WriteString(`\"`)
+		case '\\':
+			builder.WriteString(`\\`)
+		default:
+			builder.WriteByte(value[i])
+		}
+	}
+	builder.WriteByte('\'')
+
+	return builder.String()
+}
+
+// pgsqlLiteral quotes string literal, backslashes are handled by E'...' syntax
+func pgsqlLiteral(value string) string {
+	return strings.TrimSpace(pq.QuoteLiteral(value))
+}
+
+// MySQLAccount returns quoted MySQL account in format 'user'@'host'
+func MySQLAccount(user, host string) string {
+	return mysqlLiteral(user) + "@" + mysqlLiteral(host)
+}
+
+// MySQLGrantDatabase returns quoted database name for GRANT and REVOKE statements,
+// _ and % are wildcards there so they are escaped to match only the database itself.
+func MySQLGrantDatabase(name string) string {
+	return mysqlIdentifier(MySQLDatabasePattern(name))
+}
+
+// MySQLDatabasePattern returns database name with escaped wildcards as it's stored in Db column of mysql.db
+func MySQLDatabasePattern(name string) string {
+	name = strings.Replace(name, `\`, `\\`, -1)
+	name = strings.Replace(name, "_", `\_`, -1)
+	name = strings.Replace(name, "%", `\%`, -1)
+	return name
+}
@@ -0,0 +1,140 @@
+package sqlquote
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unquote reads a single quoted token from the beginning of query the same way the server's lexer does.
+// It returns the unquoted value and the rest of the query after the closing quote.
+func unquote(query string, quote byte, backslashes bool) (string, string, error) {
+	if len(query) == 0 || query[0] != quote {
+		return "", "", errors.New("missing opening quote")
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\\' && backslashes:
+			if i+1 == len(query) {
+				return "", "", errors.New("backslash at the end")
+			}
+			i++
+			switch query[i] {
+			case '0':
+				value.WriteByte(0)
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 'Z':
+				value.WriteByte('\x1a')
+			default:
+				value.WriteByte(query[i])
+			}
+		case c == quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				value.WriteByte(quote)
+				i++
+				continue
+			}
+			return value.String(), query[i+1:], nil
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return "", "", errors.New("missing closing quote")
+}
+
+// unquotePgsqlLiteral handles both standard and E'...' literals of PostgreSQL
+func unquotePgsqlLiteral(query string) (string, string, error) {
+	if strings.HasPrefix(query, "E'") {
+		return unquote(query[1:], '\'', true)
+	}
+	return unquote(query, '\'', false)
+}
+
+// checkQuoted tests the quoted value is a single token which unquotes back to the original value
+func checkQuoted(t *testing.T, value, quoted string, unquote func(string) (string, string, error)) {
+	unquoted, rest, err := unquote(quoted + ";DROP DATABASE x;")
+	if err != nil {
+		t.Fatalf("%q quoted as %q: %v", value, quoted, err)
+	}
+	if rest != ";DROP DATABASE x;" {
+		t.Fatalf("%q quoted as %q escapes its context", value, quoted)
+	}
+	if unquoted != value {
+		t.Fatalf("%q quoted as %q is read as %q", value, quoted, unquoted)
+	}
+}
+
+func mysqlIdentifierToken(query string) (string, string, error) { return unquote(query, '`', false) }
+func mysqlLiteralToken(query string) (string, string, error)    { return unquote(query, '\'', true) }
+
+// checkMySQLLiteralNoBackslashEscapes tests the quoted value is a single token with NO_BACKSLASH_ESCAPES SQL mode,
+// the value itself is read differently in that mode when it contains escaped characters.
+func checkMySQLLiteralNoBackslashEscapes(t *testing.T, value string) {
+	quoted := MySQL.Literal(value)
+	_, rest, err := unquote(quoted+";DROP DATABASE x;", '\'', false)
+	if err != nil {
+		t.Fatalf("%q quoted as %q: %v", value, quoted, err)
+	}
+	if rest != ";DROP DATABASE x;" {
+		t.Fatalf("%q quoted as %q escapes its context with NO_BACKSLASH_ESCAPES", value, quoted)
+	}
+}
+func pgsqlIdentifierToken(query string) (string, string, error) { return unquote(query, '"', false) }
+
+var quotingSamples = []string{
+	"test",
+	"",
+	"it's",
+	`back\slash`,
+	`\'; DROP DATABASE x; --`,
+	"`x`",
+	`"x"`,
+	"line\nbreak\r\x1a\x00",
+	"ěščř",
+	`'\''`,
+	`x\', 'evil'@'%' IDENTIFIED BY 'y`,
+}
+
+func TestQuoting(t *testing.T) {
+	for _, value := range quotingSamples {
+		checkQuoted(t, value, MySQL.Identifier(value), mysqlIdentifierToken)
+		checkQuoted(t, value, MySQL.Literal(value), mysqlLiteralToken)
+		checkMySQLLiteralNoBackslashEscapes(t, value)
+		checkQuoted(t, value, PostgreSQL.Literal(value), unquotePgsqlLiteral)
+		if !strings.ContainsRune(value, 0) {
+			checkQuoted(t, value, PostgreSQL.Identifier(value), pgsqlIdentifierToken)
+		}
+	}
+
+	assert.Equal(t, "`my``db`", MySQL.Identifier("my`db"))
+	assert.Equal(t, `'it''s'`, MySQL.Literal("it's"))
+	assert.Equal(t, `'x\\'', ''evil''@''%'''`, MySQL.Literal(`x\', 'evil'@'%'`))
+	assert.Equal(t, `"my""db"`, PostgreSQL.Identifier(`my"db`))
+	assert.Equal(t, `'it''s'`, PostgreSQL.Literal("it's"))
+	assert.Equal(t, `E'back\\slash'`, PostgreSQL.Literal(`back\slash`))
+}
+
+func TestValidateIdentifier(t *testing.T) {
+	assert.Nil(t, MySQL.ValidateIdentifier("test_1"))
+	assert.Nil(t, MySQL.ValidateIdentifier("it's"))
+	assert.NotNil(t, MySQL.ValidateIdentifier(""))
+	assert.NotNil(t, MySQL.ValidateIdentifier("a\x00b"))
+	assert.Nil(t, MySQL.ValidateIdentifier(strings.Repeat("a", 64)))
+	assert.NotNil(t, MySQL.ValidateIdentifier(strings.Repeat("a", 65)))
+	assert.NotNil(t, PostgreSQL.ValidateIdentifier(strings.Repeat("a", 64)))
+}
+
+func TestMySQLHelpers(t *testing.T) {
+	assert.Equal(t, `'test'@'%'`, MySQLAccount("test", "%"))
+	assert.Equal(t, "`my\\_db\\%`", MySQLGrantDatabase("my_db%"))
+	assert.Equal(t, `my\_db\%`, MySQLDatabasePattern("my_db%"))
+}
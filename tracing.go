@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation library in exported spans
+const instrumentationName = "github.com/rosti-cz/storage_service"
+
+// Span is a single timed operation of a trace
+type Span struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+// SetAttribute adds attribute to the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	case float64:
+		s.span.SetAttributes(attribute.Float64(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// StartChild starts a new span in the same trace with s as its parent
+func (s *Span) StartChild(name string, kind trace.SpanKind, start time.Time) *Span {
+	ctx, span := s.span.TracerProvider().Tracer(instrumentationName).Start(s.ctx, name, trace.WithSpanKind(kind), trace.WithTimestamp(start))
+	return &Span{ctx: ctx, span: span}
+}
+
+// Finish ends the span and hands it over to the exporter, passwords in SQL queries of the error are redacted
+func (s *Span) Finish(err error) {
+	if err != nil {
+		s.span.SetStatus(codes.Error, redactSQL(err.Error()))
+	} else {
+		s.span.SetStatus(codes.Ok, "")
+	}
+	s.span.End()
+}
+
+// TraceID returns hex encoded ID of the trace the span belongs to
+func (s *Span) TraceID() string {
+	return s.span.SpanContext().TraceID().String()
+}
+
+// spanSteps keeps track of the backend step running right now so SQL queries
+// executed by the backend are attached to it.
+type spanSteps struct {
+	parent  *Span
+	current *Span
+}
+
+// Run runs f inside a new child span of the event span
+func (s *spanSteps) Run(name string, f func() error) error {
+	s.current = s.parent.StartChild(name, trace.SpanKindInternal, time.Now())
+	err := f()
+	s.current.Finish(err)
+	s.current = nil
+	return err
+}
+
+// Active returns span of the running step or the event span if no step is running
+func (s *spanSteps) Active() *Span {
+	if s.current != nil {
+		return s.current
+	}
+	return s.parent
+}
+
+// natsHeaderCarrier gives OpenTelemetry propagators access to headers of NATS messages
+type natsHeaderCarrier nats.Header
+
+func (c natsHeaderCarrier) Get(key string) string { return nats.Header(c).Get(key) }
+func (c natsHeaderCarrier) Set(key, value string) { nats.Header(c).Set(key, value) }
+
+func (c natsHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Tracer creates spans and exports them in batches to OTLP/HTTP collector.
+// Spans are created even when the endpoint is empty but they are thrown away.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer returns tracer sending spans to endpoint (like http://localhost:4318), empty endpoint disables the export
+func NewTracer(endpoint, serviceName string) (*Tracer, error) {
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	}
+
+	if endpoint != "" {
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid OTLP endpoint")
+		}
+		if endpointURL.Host == "" || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+			return nil, errors.New("invalid OTLP endpoint " + endpoint + ", use http://host:port or https://host:port")
+		}
+
+		exporterOptions := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpointURL.Host),
+			otlptracehttp.WithURLPath(strings.TrimRight(endpointURL.Path, "/") + "/v1/traces"),
+		}
+		if endpointURL.Scheme == "http" {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+		}
+		// The exporter connects lazily so a collector that is down doesn't stop the service
+		exporter, err := otlptracehttp.New(context.Background(), exporterOptions...)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating OTLP exporter")
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	return &Tracer{
+		provider:   sdktrace.NewTracerProvider(options...),
+		propagator: propagation.TraceContext{},
+	}, nil
+}
+
+// tracer is replaced in _init() based on the config
+var tracer, _ = NewTracer("", "storage_service")
+
+// StartFromMessage starts a span for incoming message, if the message carries traceparent header
+// the span becomes part of the admin's trace.
+func (t *Tracer) StartFromMessage(name string, m *nats.Msg) *Span {
+	ctx := t.propagator.Extract(context.Background(), natsHeaderCarrier(m.Header))
+	ctx, span := t.provider.Tracer(instrumentationName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindConsumer))
+	return &Span{ctx: ctx, span: span}
+}
+
+// Shutdown exports spans still waiting in the queue and stops the exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// parentSpanID returns hex encoded ID of the parent span, empty for root spans
+func parentSpanID(span *Span) string {
+	parent := span.span.(sdktrace.ReadOnlySpan).Parent()
+	if !parent.IsValid() {
+		return ""
+	}
+	return parent.SpanID().String()
+}
+
+func TestTracerFromMessage(t *testing.T) {
+	testTracer, err := NewTracer("", "test")
+	assert.Nil(t, err)
+
+	msg := &nats.Msg{
+		Subject: "admin.storages.pgsql.devpgsql.events",
+		Header:  nats.Header{},
+	}
+	msg.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	span := testTracer.StartFromMessage("process event", msg)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID())
+	assert.Equal(t, "00f067aa0ba902b7", parentSpanID(span))
+
+	child := span.StartChild("CreateUser", trace.SpanKindInternal, span.span.(sdktrace.ReadOnlySpan).StartTime())
+	assert.Equal(t, span.TraceID(), child.TraceID())
+	assert.Equal(t, span.span.SpanContext().SpanID().String(), parentSpanID(child))
+
+	// Invalid trace context starts a new trace
+	msg.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	span = testTracer.StartFromMessage("process event", msg)
+	assert.Equal(t, "", parentSpanID(span))
+	assert.NotEqual(t, "00000000000000000000000000000000", span.TraceID())
+
+	span = testTracer.StartFromMessage("process event", &nats.Msg{})
+	assert.Equal(t, "", parentSpanID(span))
+}
+
+func TestTracerShutdown(t *testing.T) {
+	var lock sync.Mutex
+	bodies := [][]byte{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, body)
+		lock.Unlock()
+	}))
+	defer collector.Close()
+
+	testTracer, err := NewTracer(collector.URL, "test")
+	assert.Nil(t, err)
+
+	span := testTracer.StartFromMessage("process event", &nats.Msg{})
+	child := span.StartChild("SQL query", trace.SpanKindClient, span.span.(sdktrace.ReadOnlySpan).StartTime())
+	child.SetAttribute("db.statement", "ALTER USER test PASSWORD '[REDACTED]';")
+	child.Finish(errors.New("SQL query: ALTER USER test PASSWORD 'secret';"))
+	span.Finish(nil)
+
+	// Queued spans are exported by the shutdown
+	assert.Nil(t, testTracer.Shutdown(context.Background()))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Len(t, bodies, 1)
+	assert.Contains(t, string(bodies[0]), "process event")
+	assert.Contains(t, string(bodies[0]), "SQL query")
+	assert.Contains(t, string(bodies[0]), "[REDACTED]")
+	assert.NotContains(t, string(bodies[0]), "secret")
+}
+
+func TestNewTracerErrors(t *testing.T) {
+	_, err := NewTracer("localhost:4318", "test")
+	assert.NotNil(t, err)
+	_, err = NewTracer("ftp://localhost:4318", "test")
+	assert.NotNil(t, err)
+}
@@ -1,18 +1,71 @@
 package main
 
+import (
+	"context"
+	"fmt"
+
+	"github.com/rosti-cz/storage_service/dboptions"
+	"github.com/rosti-cz/storage_service/limits"
+	"github.com/rosti-cz/storage_service/roles"
+)
+
 // Message coming from the admin. Message is coming from the admin interface and
 // it says that something happening there and we should check if we should do something with it.
 type Message struct {
-	EventType  string   `json:"event_type"`
-	DBID       int      `json:"db_id"`
-	DBName     string   `json:"db_name"`
-	Username   string   `json:"username"`
-	UsernameRO string   `json:"username_ro"`
-	Password   string   `json:"password"`
-	PasswordRO string   `json:"password_ro"`
-	Extensions []string `json:"extensions"`
+	EventType         string   `json:"event_type"`
+	EventID           string   `json:"event_id"` // optional, generated by the service if empty, used in logs
+	DBID              int      `json:"db_id"`
+	DBName            string   `json:"db_name"`
+	Username          string   `json:"username"`
+	UsernameRO        string   `json:"username_ro"`
+	Password          string   `json:"password"`
+	PasswordRO        string   `json:"password_ro"`
+	Extensions        []string `json:"extensions"`         // extensions installed or updated to the latest version in created and extensions_changed events
+	ExtensionsRemoved []string `json:"extensions_removed"` // extensions dropped in extensions_changed event
+	Hosts             []string `json:"hosts"`              // optional, MySQL/MariaDB hosts new users can connect from, overrides hosts of the server
+
+	// Additional user of the storage added or removed by user_added and user_removed events
+	UsernameExtra string     `json:"username_extra"`
+	PasswordExtra string     `json:"password_extra"`
+	Role          roles.Role `json:"role"` // owner, readwrite, readonly or migrations
+
+	// Additional users of the storage dropped together with it in deleted event,
+	// other users with access to the database are left alone because the service didn't create them
+	UsernamesExtra []string `json:"usernames_extra"`
+
+	Limits *limits.Limits `json:"limits"` // optional in created event, resource limits of the user
+
+	// Optional charset, collation, locale and template of created database, defaults of the server are used for missing ones
+	dboptions.Options
+
+	// Passwords generated by the service sealed with the admin's public key, they are sent back in the state
+	sealedPassword      string
+	sealedPasswordRO    string
+	sealedPasswordExtra string
+
+	// Extensions installed in the database after the event, they are sent back in the state
+	installedExtensions map[string]string
+	// Users of the database after the event, they are sent back in the state
+	databaseUsers []string
 }
 
+// String returns the message without passwords so it can be logged safely
+func (m Message) String() string {
+	if m.Password != "" {
+		m.Password = redacted
+	}
+	if m.PasswordRO != "" {
+		m.PasswordRO = redacted
+	}
+	if m.PasswordExtra != "" {
+		m.PasswordExtra = redacted
+	}
+	return fmt.Sprintf("%+v", messageWithoutStringer(m))
+}
+
+// messageWithoutStringer prevents infinite recursion in Message.String()
+type messageWithoutStringer Message
+
 // State is async response back to the admin and it says if something was done.
 // If admin tells us that database was created we should create it in the database instance locally
 // and return State message back to admin.
@@ -21,22 +74,35 @@ type State struct {
 	DBName  string `json:"db_name"`
 	Error   bool   `json:"error"`   // true if there was an error
 	Message string `json:"message"` // error message or state like created,password_changed or deleted
+
+	Password   string `json:"password,omitempty"`    // password generated by the service, encrypted by the admin's public key
+	PasswordRO string `json:"password_ro,omitempty"` // RO password generated by the service, encrypted by the admin's public key
+
+	PasswordExtra string `json:"password_extra,omitempty"` // password of additional user generated by the service, encrypted by the admin's public key
+
+	Extensions map[string]string `json:"extensions,omitempty"` // extensions installed in the database and their versions
+	Users      []string          `json:"users,omitempty"`      // users with access to the database
 }
 
 // Backend is interface to handle databases
 type Backend interface {
 	CreateUser(user, password, database string) error
 	CreateROUser(user, password, database string) error
-	CreateDatabase(database, owner string, extensions []string) error
+	CreateDatabase(database, owner string, extensions []string, options dboptions.Options) error
+	ChangeDatabaseOptions(database string, options dboptions.Options) error
 	ChangePassword(user, password string) error
 	DropUser(user string) error
+	DropROUser(user, database string) error
+	CreateExtraUser(user, password, database string, role roles.Role) error
+	DropExtraUser(user, database string) error
+	Users(database string) ([]string, error)
+	TerminateSessions(user, database string) error
 	DropDatabase(database string) error
-}
-
-// Metrics is used to share status of the service with the ecosystem
-type Metrics struct {
-	Messages int    `json:"messages"`
-	Service  string `json:"service"`
+	SetLimits(user string, userLimits limits.Limits) error
+	ChangeExtensions(database string, install, remove []string) error
+	Extensions(database string) (map[string]string, error)
+	Ping(ctx context.Context) error
+	ClosePool() error
 }
 
 // Structure for metrics message compatible with metrics-receiver